@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+
+	"github.com/riobard/go-shadowsocks2/shadowaead"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// maximum number of packets per batch read or write
+const batchSize = 16
+
+// readBatch reads packets into ms, several at a time if c supports it.
+func readBatch(c net.PacketConn, ms []ipv4.Message) (int, error) {
+	if bc, ok := c.(shadowaead.BatchConn); ok {
+		return bc.ReadBatch(ms, 0)
+	}
+	n, addr, err := c.ReadFrom(ms[0].Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].Addr = n, addr
+	return 1, nil
+}
+
+// writeBatch writes all packets in ms, several at a time if c supports it.
+func writeBatch(c net.PacketConn, ms []ipv4.Message) error {
+	bc, ok := c.(shadowaead.BatchConn)
+	for len(ms) > 0 {
+		if !ok {
+			if _, err := c.WriteTo(ms[0].Buffers[0], ms[0].Addr); err != nil {
+				return err
+			}
+			ms = ms[1:]
+			continue
+		}
+		n, err := bc.WriteBatch(ms, 0)
+		if err != nil {
+			return err
+		}
+		ms = ms[n:]
+	}
+	return nil
+}
+
+// batchConn adds batch I/O to a UDP socket.
+type batchConn struct {
+	*net.UDPConn
+	shadowaead.BatchConn
+}
+
+// batchable returns c with batch I/O where the platform supports it.
+func batchable(c net.PacketConn) net.PacketConn {
+	uc, ok := c.(*net.UDPConn)
+	if !ok || !batchSupported {
+		return c
+	}
+	if a, ok := uc.LocalAddr().(*net.UDPAddr); ok && a.IP.To4() != nil {
+		return &batchConn{uc, ipv4.NewPacketConn(uc)}
+	}
+	return &batchConn{uc, ipv6.NewPacketConn(uc)}
+}
@@ -0,0 +1,4 @@
+package main
+
+// recvmmsg and sendmmsg are available
+const batchSupported = true
@@ -1,36 +1,238 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
+	"net"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 )
 
-var config struct {
-	Verbose    bool
-	UDP        bool
-	UDPTimeout time.Duration
-	Client     SpaceSeparatedList
-	Server     SpaceSeparatedList
-	TCPTun     PairList
-	UDPTun     PairList
-	Socks      string
-	RedirTCP   string
-	TproxyTCP  string
+type Config struct {
+	Verbose         bool
+	UDP             bool
+	UDPTimeout      time.Duration
+	Client          SpaceSeparatedList
+	Server          SpaceSeparatedList
+	TCPTun          PairList
+	UDPTun          PairList
+	Socks           string
+	RedirTCP        string
+	TproxyTCP       string
+	File            string
+	Admin           string
+	Drain           time.Duration
+	Metrics         string
+	Usage           string
+	IPLimit         string
+	UDPNAT          string
+	UDPQueue        int
+	UDPQueueMem     string
+	UDPDrop         string
+	Resolver        SpaceSeparatedList
+	ResolverPrefer  string
+	DialTimeout     time.Duration
+	DNS             string
+	DNSUpstream     string
+	DNSDirect       string
+	DNSDirectServer string
+	FakeIP          string
+	Sniff           bool
+	Strategy        string
+	DialAttempts    int
+	DialDeadline    time.Duration
+	Race            int
+	RaceDelay       time.Duration
+	Breaker         int
+	BreakerBackoff  time.Duration
+	Pool            int
+	PoolIdle        time.Duration
+	Probe           string
+	ProbeInterval   time.Duration
+	Mux             int
+	Plugin          string
+	PluginOpts      string
+	Forward         string
 }
 
+var config Config
+
 func init() {
-	flag.BoolVar(&config.Verbose, "verbose", false, "verbose mode")
-	flag.Var(&config.Server, "s", "server listen url")
-	flag.Var(&config.Client, "c", "client connect url")
-	flag.Var(&config.TCPTun, "tcptun", "(client-only) TCP tunnel (laddr1=raddr1,laddr2=raddr2,...)")
-	flag.Var(&config.UDPTun, "udptun", "(client-only) UDP tunnel (laddr1=raddr1,laddr2=raddr2,...)")
-	flag.StringVar(&config.Socks, "socks", "", "(client-only) SOCKS listen address")
-	flag.StringVar(&config.RedirTCP, "redir", "", "(client-only) redirect TCP from this address")
-	flag.StringVar(&config.TproxyTCP, "tproxytcp", "", "(Linux client-only) TPROXY TCP listen address")
-	flag.BoolVar(&config.UDP, "udp", false, "(server-only) UDP support")
-	flag.DurationVar(&config.UDPTimeout, "udptimeout", 120*time.Second, "UDP tunnel timeout")
+	config.register(flag.CommandLine)
+}
+
+func (c *Config) register(fs *flag.FlagSet) {
+	fs.BoolVar(&c.Verbose, "verbose", false, "verbose mode")
+	fs.Var(&c.Server, "s", "server listen url")
+	fs.Var(&c.Client, "c", "client connect url")
+	fs.Var(&c.TCPTun, "tcptun", "(client-only) TCP tunnel (laddr1=raddr1,laddr2=raddr2,...)")
+	fs.Var(&c.UDPTun, "udptun", "(client-only) UDP tunnel (laddr1=raddr1,laddr2=raddr2,...)")
+	fs.StringVar(&c.Socks, "socks", "", "(client-only) SOCKS listen address")
+	fs.StringVar(&c.RedirTCP, "redir", "", "(client-only) redirect TCP from this address")
+	fs.StringVar(&c.TproxyTCP, "tproxytcp", "", "(Linux client-only) TPROXY TCP listen address")
+	fs.StringVar(&c.DNS, "dns", "", "(client-only) DNS forwarder UDP and TCP listen address")
+	fs.StringVar(&c.DNSUpstream, "dnsupstream", "udp://8.8.8.8:53", "(client-only) DNS server reached through the server (udp:// or tcp:// URL)")
+	fs.StringVar(&c.DNSDirect, "dnsdirect", "", "(client-only) comma-separated domains resolved by -dnsdirectserver instead")
+	fs.StringVar(&c.DNSDirectServer, "dnsdirectserver", "", "(client-only) DNS server for -dnsdirect domains (udp://, tcp:// or tls:// URL)")
+	fs.StringVar(&c.FakeIP, "fakeip", "", "(client-only) answer -dns queries with addresses from this range and redirect them back to domains (e.g. 198.18.0.0/15)")
+	fs.BoolVar(&c.Sniff, "sniff", false, "(client-only) take TLS SNI or HTTP Host as the target of redir and tproxy connections")
+	fs.StringVar(&c.Strategy, "strategy", "latency", "(client-only) server selection: latency, roundrobin, random (by weight=N in URLs), leastconn or hash (of target host)")
+	fs.IntVar(&c.DialAttempts, "dialattempts", 3, "(client-only) servers to try in turn per connection")
+	fs.DurationVar(&c.DialDeadline, "dialdeadline", 10*time.Second, "(client-only) time to connect through any server per connection")
+	fs.IntVar(&c.Race, "race", 1, "(client-only) servers to race per connection, the first to connect wins")
+	fs.DurationVar(&c.RaceDelay, "racedelay", 250*time.Millisecond, "(client-only) delay before racing the next server")
+	fs.IntVar(&c.Breaker, "breaker", 0, "(client-only) consecutive failed dials to stop using a server for a while, 0 to disable")
+	fs.DurationVar(&c.BreakerBackoff, "breakerbackoff", time.Second, "(client-only) initial time to stop using a failing server, doubling up to 5m")
+	fs.IntVar(&c.Pool, "pool", 0, "(client-only) connected TCP connections to keep ready per server")
+	fs.DurationVar(&c.PoolIdle, "poolidle", 30*time.Second, "(client-only) time before replacing an unused pooled connection")
+	fs.StringVar(&c.Probe, "probe", "", "(client-only) health check servers by requesting this target through them (http://host/path or echo://host:port)")
+	fs.DurationVar(&c.ProbeInterval, "probeinterval", 30*time.Second, "(client-only) interval of health checks")
+	fs.StringVar(&c.Plugin, "plugin", "", "SIP003 plugin for URLs without plugin=name;opts")
+	fs.StringVar(&c.PluginOpts, "pluginopts", "", "options of -plugin")
+	fs.IntVar(&c.Mux, "mux", 0, "(client-only) multiplex up to this many TCP streams over each connection to a server, 0 to disable (not with -strategy hash)")
+	fs.BoolVar(&c.UDP, "udp", false, "(server-only) UDP support")
+	fs.StringVar(&c.UDPNAT, "udpnat", "full", "(server-only) UDP NAT filtering: full, restricted or portrestricted")
+	fs.IntVar(&c.UDPQueue, "udpqueue", 16, "UDP packets queued per session")
+	fs.StringVar(&c.UDPQueueMem, "udpqueuemem", "64M", "memory for UDP packets queued across all sessions")
+	fs.StringVar(&c.UDPDrop, "udpdrop", "newest", "UDP packet to drop when a session queue is full: newest or oldest")
+	fs.DurationVar(&c.UDPTimeout, "udptimeout", 120*time.Second, "UDP tunnel timeout")
+	fs.StringVar(&c.File, "config", "", "config file with one flag per line (re-read on SIGHUP)")
+	fs.StringVar(&c.Admin, "admin", "", "admin HTTP listen address")
+	fs.StringVar(&c.Metrics, "metrics", "", "Prometheus metrics listen address")
+	fs.StringVar(&c.Usage, "usage", "", "(server-only) file to persist per-user traffic counters")
+	fs.StringVar(&c.IPLimit, "iplimit", "", "(server-only) rate limit per client IP in bytes/s (UP[:BURST],DOWN[:BURST])")
+	fs.StringVar(&c.Forward, "forward", "", "(server-only) relay every connection to this address instead of its target")
+	fs.DurationVar(&c.DialTimeout, "dialtimeout", 10*time.Second, "(server-only) time to connect to a target, 0 for no limit")
+	fs.Var(&c.Resolver, "resolver", "(server-only) upstream DNS servers for target domains (udp://, tcp:// or tls:// URLs)")
+	fs.StringVar(&c.ResolverPrefer, "resolverprefer", "", "(server-only) preferred target address family: ipv4 or ipv6")
+	fs.DurationVar(&c.Drain, "draintimeout", 10*time.Second, "time to let in-flight relays finish on shutdown")
+}
+
+// load sets flags in fs from the config file, one "name value" pair per line.
+// Blank lines and lines starting with # are ignored.
+func (c *Config) load(fs *flag.FlagSet) error {
+	if err := c.loadPlugin(fs); err != nil {
+		return err
+	}
+	if c.File == "" {
+		return nil
+	}
+	f, err := os.Open(c.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, value := line, "true" // bare boolean flag
+		if i := strings.IndexAny(line, " \t"); i > 0 {
+			name, value = line[:i], strings.TrimSpace(line[i:])
+		}
+		if err := fs.Set(strings.TrimLeft(name, "-"), value); err != nil {
+			return fmt.Errorf("%s:%d: %v", c.File, n, err)
+		}
+	}
+	return s.Err()
+}
+
+// loadPlugin configures c from the environment if started as a SIP003 plugin
+// by another shadowsocks implementation: as a server on SS_REMOTE_HOST and
+// SS_REMOTE_PORT relaying to SS_LOCAL_HOST and SS_LOCAL_PORT if
+// SS_PLUGIN_OPTIONS has "server", otherwise as a client the other way round.
+// Options cipher and password default to DUMMY, as the frontend encrypts
+// already. Options transport, path, host, cert and key go to the URL, and
+// others set flags, e.g. "server;transport=ws;path=/ss;mux=8;verbose".
+func (c *Config) loadPlugin(fs *flag.FlagSet) error {
+	rhost, rport := os.Getenv("SS_REMOTE_HOST"), os.Getenv("SS_REMOTE_PORT")
+	lhost, lport := os.Getenv("SS_LOCAL_HOST"), os.Getenv("SS_LOCAL_PORT")
+	if rhost == "" || rport == "" || lhost == "" || lport == "" {
+		return nil
+	}
+	remote, local := net.JoinHostPort(rhost, rport), net.JoinHostPort(lhost, lport)
+
+	server, cipher, password := false, "DUMMY", ""
+	q := make(url.Values)
+	for _, opt := range splitPluginOptions(os.Getenv("SS_PLUGIN_OPTIONS")) {
+		switch name, value := opt[0], opt[1]; name {
+		case "server":
+			server = true
+		case "cipher":
+			cipher = value
+		case "password":
+			password = value
+		case "transport", "path", "host", "cert", "key": // of the URL
+			q.Set(name, value)
+		default:
+			if value == "" {
+				value = "true" // bare boolean flag
+			}
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("SS_PLUGIN_OPTIONS: %v", err)
+			}
+		}
+	}
+
+	u := &url.URL{Scheme: "ss", User: url.UserPassword(cipher, password), Host: remote, RawQuery: q.Encode()}
+	if server {
+		c.Server = SpaceSeparatedList{u.String()}
+		c.Forward = local
+	} else {
+		c.Client = SpaceSeparatedList{u.String()}
+		c.TCPTun = PairList{{local, remote}} // the server forwards regardless
+	}
+	return nil
+}
+
+// splitPluginOptions splits SIP003 options "a=1;b" into name-value pairs,
+// with backslash escaping any character.
+func splitPluginOptions(s string) [][2]string {
+	var opts [][2]string
+	var opt [2]string
+	var b strings.Builder
+	i := 0 // in opt
+	for j := 0; j < len(s); j++ {
+		switch ch := s[j]; {
+		case ch == '\\' && j+1 < len(s):
+			j++
+			b.WriteByte(s[j])
+		case ch == '=' && i == 0:
+			opt[0], i = b.String(), 1
+			b.Reset()
+		case ch == ';':
+			opt[i] = b.String()
+			if opt[0] != "" {
+				opts = append(opts, opt)
+			}
+			opt, i = [2]string{}, 0
+			b.Reset()
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	opt[i] = b.String()
+	if opt[0] != "" {
+		opts = append(opts, opt)
+	}
+	return opts
+}
+
+// loadConfig parses the command line again followed by the config file.
+func loadConfig() (*Config, error) {
+	c := new(Config)
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	c.register(fs)
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		return nil, err
+	}
+	return c, c.load(fs)
 }
 
 func parseURL(s string) (addr, cipher, password string, err error) {
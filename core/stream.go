@@ -1,6 +1,9 @@
 package core
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
 type listener struct {
 	net.Listener
@@ -18,6 +21,15 @@ func (l *listener) Accept() (net.Conn, error) {
 }
 
 func Dial(network, address string, ciph StreamConnCipher) (net.Conn, error) {
-	c, err := net.Dial(network, address)
-	return ciph.StreamConn(c), err
+	return DialContext(context.Background(), network, address, ciph)
+}
+
+// DialContext is like Dial but gives up once ctx is done.
+func DialContext(ctx context.Context, network, address string, ciph StreamConnCipher) (net.Conn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return ciph.StreamConn(c), nil
 }
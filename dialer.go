@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/riobard/go-shadowsocks2/core"
 	"github.com/riobard/go-shadowsocks2/socks"
@@ -11,17 +17,56 @@ import (
 
 type Dialer interface {
 	Dial(network, address string) (net.Conn, error)
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
 
+// swapDialer forwards to the Dialer most recently stored, so that reloading
+// the client servers does not restart local listeners.
+type swapDialer struct{ v atomic.Value }
+
+var clientDialer swapDialer
+
+func (d *swapDialer) Store(dd Dialer) { d.v.Store(dd) }
+func (d *swapDialer) Dial(network, address string) (net.Conn, error) {
+	return d.v.Load().(Dialer).Dial(network, address)
+}
+func (d *swapDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.v.Load().(Dialer).DialContext(ctx, network, address)
+}
+
+// longest time a failing server is left alone before dialing it again
+const breakerMaxBackoff = 5 * time.Minute
+
 type dialer struct {
 	*speeddial.Dialer
+	addrs []string                // server addresses in the order of targets
+	dials []speeddial.ContextDial // of each server, with cipher, plugin and transport
+	stop  func()                  // stops connection pools
+	mux   *muxPool                // nil unless multiplexing
+}
+
+// Close stops background dials, health checks and connection pools.
+func (d dialer) Close() error {
+	d.stop()
+	return d.Dialer.Close()
 }
 
 func (d dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	if network != "tcp" {
 		return nil, errors.New("only TCP network is supported")
 	}
-	c, err := d.Dialer.Dial()
+	host, _, _ := net.SplitHostPort(address)
+	var c net.Conn
+	var err error
+	if d.mux != nil {
+		c, err = d.mux.open(ctx)
+	} else {
+		c, err = d.Dialer.DialContext(ctx, host)
+	}
 	if err != nil {
 		return c, err
 	}
@@ -32,27 +77,128 @@ func (d dialer) Dial(network, address string) (net.Conn, error) {
 	return c, err
 }
 
-func fastdialer(u ...string) (*dialer, error) {
-	rs := make([]speeddial.Dial, len(u))
+// dialServer connects to the client server at addr, bypassing the strategy.
+func dialServer(ctx context.Context, addr string) (net.Conn, error) {
+	if d, ok := clientDialer.v.Load().(*dialer); ok {
+		for i := range d.addrs {
+			if d.addrs[i] == addr {
+				return d.dials[i](ctx)
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown server %s", addr)
+}
+
+func fastdialer(cfg *Config) (*dialer, error) {
+	u := cfg.Client
+	st, err := speeddial.ParseStrategy(cfg.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Pool > 0 && cfg.PoolIdle <= 0 {
+		return nil, fmt.Errorf("invalid -poolidle %v", cfg.PoolIdle)
+	}
+	if cfg.Mux > 0 && st == speeddial.ConsistentHash {
+		return nil, errors.New("-strategy hash and -mux are exclusive, as streams share sessions whatever their target")
+	}
+	addrs := make([]string, len(u))
+	plugins := make([]*plugin, len(u))
+	trs := make([]*transport, len(u))
+	weights := make([]int, len(u))
+	ciphs := make([]core.Cipher, len(u))
 	for i := range u {
 		addr, cipher, password, err := parseURL(u[i])
 		if err != nil {
 			return nil, err
 		}
-
-		ciph, err := core.PickCipher(cipher, nil, password)
+		if weights[i], err = parseWeight(u[i]); err != nil {
+			return nil, err
+		}
+		if ciphs[i], err = core.PickCipher(cipher, nil, password); err != nil {
+			return nil, err
+		}
+		addrs[i] = addr
+		name, opts, err := parsePlugin(u[i], cfg.Plugin, cfg.PluginOpts)
 		if err != nil {
 			return nil, err
 		}
+		if trs[i], err = parseTransport(u[i]); err != nil {
+			return nil, err
+		}
+		if name != "" && trs[i].ws {
+			return nil, fmt.Errorf("%s: plugin and WebSocket transport are exclusive", addr)
+		}
+		if name != "" {
+			if plugins[i], err = clientPlugin(name, opts, addr); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-		rs[i] = func() (net.Conn, error) {
-			c, err := net.Dial("tcp", addr)
+	rs := make([]speeddial.ContextDial, len(u))
+	poolCtx, stop := context.WithCancel(context.Background())
+	for i := range u {
+		addr, plug, tr, ciph := addrs[i], plugins[i], trs[i], ciphs[i]
+		connect := func(ctx context.Context) (net.Conn, error) {
+			if plug != nil {
+				return plug.dial(ctx, tr.dial)
+			}
+			return tr.dial(ctx, addr)
+		}
+		var pool *connPool
+		if cfg.Pool > 0 {
+			pool = newConnPool(poolCtx, addr, connect, cfg.Pool, cfg.PoolIdle)
+		}
+		rs[i] = func(ctx context.Context) (net.Conn, error) {
+			if pool != nil && !speeddial.WarmUp(ctx) { // warm-ups measure fresh dials
+				if c, latency := pool.get(); c != nil {
+					observeDial(addr, time.Now().Add(-latency), nil)
+					return &pooledStream{ciph.StreamConn(c), latency}, nil
+				}
+			}
+			t0 := time.Now()
+			c, err := connect(ctx)
+			observeDial(addr, t0, err)
 			if err != nil {
-				return c, err
+				return nil, err
 			}
-			c = ciph.StreamConn(c)
-			return c, nil
+			return ciph.StreamConn(c), nil
 		}
 	}
-	return &dialer{speeddial.New(rs...)}, nil
+	d := speeddial.NewContext(rs, speeddial.WithStrategy(st), speeddial.WithWeights(weights...),
+		speeddial.WithRetry(cfg.DialAttempts, cfg.DialDeadline),
+		speeddial.WithRace(cfg.Race, cfg.RaceDelay),
+		speeddial.WithBreaker(cfg.Breaker, cfg.BreakerBackoff, breakerMaxBackoff))
+	dd := &dialer{Dialer: d, addrs: addrs, dials: rs, stop: stop}
+	if cfg.Mux > 0 {
+		dd.mux = &muxPool{dial: func(ctx context.Context) (net.Conn, error) { return d.DialContext(ctx, "") }, streams: cfg.Mux}
+	}
+	return dd, nil
+}
+
+// pooledStream is a stream over a pooled connection, reporting to speeddial
+// how long the connection took to dial rather than to hand out.
+type pooledStream struct {
+	net.Conn
+	latency time.Duration
+}
+
+func (c *pooledStream) DialLatency() time.Duration { return c.latency }
+
+// parseWeight returns the weight=N of a client URL for random strategy,
+// default 1.
+func parseWeight(s string) (int, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return 0, err
+	}
+	w := u.Query().Get("weight")
+	if w == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(w)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid weight %q", w)
+	}
+	return n, nil
 }
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/riobard/go-shadowsocks2/resolver"
+	"github.com/riobard/go-shadowsocks2/socks"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTimeout     = 5 * time.Second
+	dnsNegativeTTL = 30 * time.Second // for answers without records
+	dnsMaxTTL      = time.Hour
+	dnsMaxEntries  = 10000
+	dnsMaxQueries  = 256 // UDP queries answered at once, others are dropped
+)
+
+// dnsForwarder answers DNS queries from its cache, from a direct resolver for
+// selected domains, or from an upstream resolver through the servers.
+type dnsForwarder struct {
+	upstream  socks.Addr
+	overTCP   bool         // DNS over TCP inside a shadowsocks stream, else over UDP
+	servers   []*udpServer // for queries over UDP
+	direct    []string     // domains resolved by directSrv, including their subdomains
+	directNet string
+	directSrv string
+
+	queries chan struct{} // semaphore of UDP queries in progress
+
+	mu    sync.Mutex
+	cache map[dnsmessage.Question]dnsAnswer
+}
+
+type dnsAnswer struct {
+	msg     []byte
+	expires time.Time
+}
+
+// newDNSForwarder creates a forwarder to upstream, a udp:// or tcp:// URL of
+// the resolver reached through the servers. Domains in direct are sent to
+// directSrv, a udp://, tcp:// or tls:// URL, instead.
+func newDNSForwarder(upstream string, servers []*udpServer, direct []string, directSrv string) (*dnsForwarder, error) {
+	network, addr, err := dnsURL(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if network == "tls" {
+		return nil, fmt.Errorf("DNS over TLS through the servers is not supported: %q", upstream)
+	}
+	f := &dnsForwarder{
+		upstream: socks.ParseAddr(addr),
+		overTCP:  network == "tcp",
+		servers:  servers,
+		queries:  make(chan struct{}, dnsMaxQueries),
+		cache:    make(map[dnsmessage.Question]dnsAnswer),
+	}
+	if f.upstream == nil {
+		return nil, fmt.Errorf("invalid DNS upstream %q", upstream)
+	}
+	if !f.overTCP && len(servers) == 0 {
+		return nil, errors.New("no server for DNS over UDP")
+	}
+	for _, d := range direct {
+		if d = strings.ToLower(strings.Trim(d, ".")); d != "" {
+			f.direct = append(f.direct, d)
+		}
+	}
+	if len(f.direct) > 0 {
+		if directSrv == "" {
+			return nil, errors.New("direct DNS domains need -dnsdirectserver")
+		}
+		if f.directNet, f.directSrv, err = dnsURL(directSrv); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// dnsURL splits a DNS server URL into network and address. A bare address
+// means UDP.
+func dnsURL(s string) (network, addr string, err error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+	default:
+		return "", "", fmt.Errorf("unsupported DNS server %q", s)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return "", "", fmt.Errorf("invalid DNS server %q: %v", s, err)
+	}
+	return u.Scheme, u.Host, nil
+}
+
+// serveUDP answers queries received on c until it is closed.
+func (f *dnsForwarder) serveUDP(c net.PacketConn) {
+	defer c.Close()
+	buf := make([]byte, udpBufSize)
+	for {
+		n, raddr, err := c.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logf("DNS read error: %v", err)
+			continue
+		}
+		select {
+		case f.queries <- struct{}{}:
+		default:
+			logf("DNS query from %v dropped: too many in progress", raddr)
+			continue
+		}
+		q := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer func() { <-f.queries }()
+			resp, err := f.answer(q)
+			if err != nil {
+				logf("DNS query from %v failed: %v", raddr, err)
+				return
+			}
+			c.WriteTo(resp, raddr)
+		}()
+	}
+}
+
+// serveTCP answers queries on connections accepted from l until it is closed.
+func (f *dnsForwarder) serveTCP(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logf("failed to accept: %v", err)
+			continue
+		}
+		go func() {
+			defer c.Close()
+			for {
+				c.SetReadDeadline(time.Now().Add(config.UDPTimeout))
+				q, err := resolver.ReadMsg(c)
+				if err != nil {
+					return
+				}
+				resp, err := f.answer(q)
+				if err != nil {
+					logf("DNS query from %v failed: %v", c.RemoteAddr(), err)
+					return
+				}
+				if err := resolver.WriteMsg(c, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// answer returns the response to query q.
+func (f *dnsForwarder) answer(q []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(q)
+	if err != nil {
+		return nil, err
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(question.Name.String())
+	copy(question.Name.Data[:], name) // cache case-insensitively
+	name = strings.TrimSuffix(name, ".")
+	direct := f.isDirect(name)
+
+	if p := currentFakeIPs(); p != nil && !direct && question.Class == dnsmessage.ClassINET &&
+		(question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypeAAAA) {
+		return p.answer(h, question)
+	}
+
+	if resp := f.cached(question); resp != nil {
+		resp[0], resp[1] = byte(h.ID>>8), byte(h.ID)
+		return resp, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	var resp []byte
+	if direct {
+		logf("DNS %s direct via %s", name, f.directSrv)
+		resp, err = resolver.Exchange(ctx, f.directNet, f.directSrv, q)
+	} else if f.overTCP {
+		resp, err = f.exchangeTCP(ctx, q)
+	} else {
+		resp, err = f.exchangeUDP(q)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.store(question, resp)
+	return resp, nil
+}
+
+func (f *dnsForwarder) isDirect(name string) bool {
+	for _, d := range f.direct {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeTCP sends q as DNS over TCP inside a shadowsocks stream.
+func (f *dnsForwarder) exchangeTCP(ctx context.Context, q []byte) ([]byte, error) {
+	c, err := clientDialer.DialContext(ctx, "tcp", f.upstream.String())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(dnsTimeout))
+	if err := resolver.WriteMsg(c, q); err != nil {
+		return nil, err
+	}
+	return resolver.ReadMsg(c)
+}
+
+// exchangeUDP sends q in a UDP session through one of the servers.
+func (f *dnsForwarder) exchangeUDP(q []byte) ([]byte, error) {
+	srv := pickUDPServer(f.servers)
+	if srv.addr == nil {
+		return nil, fmt.Errorf("UDP server address of %s not resolved", srv.host)
+	}
+	pc, err := srv.listen()
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(dnsTimeout))
+
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+	n := copy(buf, f.upstream)
+	n += copy(buf[n:], q)
+	if _, err := pc.WriteTo(buf[:n], srv.addr); err != nil {
+		return nil, err
+	}
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		src := socks.SplitAddr(buf[:n])
+		resp := buf[len(src):n]
+		if len(resp) >= 2 && bytes.Equal(resp[:2], q[:2]) {
+			return append([]byte(nil), resp...), nil
+		}
+	}
+}
+
+// cached returns a copy of the unexpired cached response to question, or nil.
+func (f *dnsForwarder) cached(question dnsmessage.Question) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	a, ok := f.cache[question]
+	if !ok || time.Now().After(a.expires) {
+		return nil
+	}
+	return append([]byte(nil), a.msg...)
+}
+
+// store caches resp for the lowest TTL of its answers. Failures are not cached.
+func (f *dnsForwarder) store(question dnsmessage.Question, resp []byte) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil || h.Truncated || (h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError) {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	ttl := dnsNegativeTTL
+	if answers, err := p.AllAnswers(); err == nil && len(answers) > 0 {
+		ttl = dnsMaxTTL
+		for _, a := range answers {
+			if t := time.Duration(a.Header.TTL) * time.Second; t < ttl {
+				ttl = t
+			}
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.cache) >= dnsMaxEntries {
+		f.sweep()
+	}
+	f.cache[question] = dnsAnswer{resp, time.Now().Add(ttl)}
+}
+
+// sweep removes expired entries, then arbitrary others while still above 90%
+// of dnsMaxEntries. Caller must hold f.mu.
+func (f *dnsForwarder) sweep() {
+	now := time.Now()
+	for _, all := range []bool{false, true} {
+		for k, a := range f.cache {
+			if all && len(f.cache) < dnsMaxEntries*9/10 {
+				return
+			}
+			if all || now.After(a.expires) {
+				delete(f.cache, k)
+			}
+		}
+	}
+}
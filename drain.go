@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// number of in-flight TCP relays and UDP sessions in udpLocal and udpRemote
+var inflight struct{ relays, udpLocal, udpRemote int64 }
+
+// track counts c in n, unless nil, until the returned function is called. c
+// is closed early if ctx is done before then.
+func track(ctx context.Context, c io.Closer, n *int64) func() {
+	if n != nil {
+		atomic.AddInt64(n, 1)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		if n != nil {
+			atomic.AddInt64(n, -1)
+		}
+	}
+}
+
+// shutdown stops accepting, waits up to timeout for in-flight TCP relays to
+// finish, then force-closes everything left by calling cancel.
+func shutdown(cancel context.CancelFunc, timeout time.Duration) {
+	stopAll()
+	if d, ok := clientDialer.v.Load().(*dialer); ok {
+		d.Close()
+	}
+
+	logf("draining %d TCP relays", atomic.LoadInt64(&inflight.relays))
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&inflight.relays) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	relays := atomic.LoadInt64(&inflight.relays)
+	sessions := atomic.LoadInt64(&inflight.udpLocal) + atomic.LoadInt64(&inflight.udpRemote)
+	cancel()
+	stopPlugins() // kept running for the relays through them
+	log.Printf("shutdown: interrupted %d TCP relays and %d UDP sessions", relays, sessions)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TTL of fake answers, short so that clients come back for a fresh address
+// should the mapping be recycled.
+const fakeIPTTL = 1
+
+// fakeIPPool hands out IPv4 addresses from a reserved range to domains and
+// remembers the mappings. Once the range is used up, the oldest mappings are
+// recycled.
+type fakeIPPool struct {
+	sync.Mutex
+	cidr  string
+	base  uint32
+	size  uint32
+	next  uint32 // offset of the next address to hand out
+	names map[uint32]string
+	ips   map[string]uint32
+}
+
+// fake IP pool shared by the DNS forwarder and redir/tproxy listeners
+var fakeIPs struct {
+	sync.Mutex
+	p *fakeIPPool
+}
+
+// prepareFakeIP returns a function changing the range of fake addresses,
+// keeping the mappings if it does not change. An empty cidr disables fake IPs.
+func prepareFakeIP(cidr string) (func(), error) {
+	var p *fakeIPPool
+	if cidr != "" {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := n.Mask.Size()
+		if bits != 32 || ones > 30 {
+			return nil, fmt.Errorf("fake IP range must be IPv4 of at least 4 addresses: %q", cidr)
+		}
+		p = &fakeIPPool{
+			cidr:  cidr,
+			base:  binary.BigEndian.Uint32(n.IP.To4()),
+			size:  1 << uint(bits-ones),
+			next:  1, // skip the network address
+			names: make(map[uint32]string),
+			ips:   make(map[string]uint32),
+		}
+	}
+	return func() {
+		fakeIPs.Lock()
+		defer fakeIPs.Unlock()
+		if p == nil || fakeIPs.p == nil || fakeIPs.p.cidr != cidr {
+			fakeIPs.p = p
+		}
+	}, nil
+}
+
+// currentFakeIPs returns the fake IP pool, or nil if disabled.
+func currentFakeIPs() *fakeIPPool {
+	fakeIPs.Lock()
+	defer fakeIPs.Unlock()
+	return fakeIPs.p
+}
+
+// fakeDomain returns the domain ip was handed out to.
+func fakeDomain(ip net.IP) (string, bool) {
+	p := currentFakeIPs()
+	ip4 := ip.To4()
+	if p == nil || ip4 == nil {
+		return "", false
+	}
+	p.Lock()
+	defer p.Unlock()
+	name, ok := p.names[binary.BigEndian.Uint32(ip4)]
+	return name, ok
+}
+
+// get returns the fake address of domain, handing out one if needed.
+func (p *fakeIPPool) get(domain string) net.IP {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	p.Lock()
+	defer p.Unlock()
+	a, ok := p.ips[domain]
+	if !ok {
+		a = p.base + p.next
+		if old, ok := p.names[a]; ok {
+			delete(p.ips, old)
+		}
+		p.names[a] = domain
+		p.ips[domain] = a
+		if p.next++; p.next == p.size-1 { // skip the broadcast address
+			p.next = 1
+		}
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, a)
+	return ip
+}
+
+// answer builds the response to an A or AAAA query with header h. AAAA
+// queries get an empty answer so that clients use the fake IPv4 address.
+func (p *fakeIPPool) answer(h dnsmessage.Header, question dnsmessage.Question) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(question); err != nil {
+		return nil, err
+	}
+	if question.Type == dnsmessage.TypeA {
+		if err := b.StartAnswers(); err != nil {
+			return nil, err
+		}
+		var a dnsmessage.AResource
+		copy(a.A[:], p.get(question.Name.String()))
+		rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: fakeIPTTL}
+		if err := b.AResource(rh, a); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
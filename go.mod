@@ -1,5 +1,10 @@
 module github.com/riobard/go-shadowsocks2
 
-go 1.15
+go 1.17
 
-require golang.org/x/crypto v0.0.0-20200128174031-69ecbb4d6d5d
+require (
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/net v0.7.0
+)
+
+require golang.org/x/sys v0.5.0 // indirect
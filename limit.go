@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket shared by all connections it limits.
+type bucket struct {
+	sync.Mutex
+	rate   float64 // bytes per second
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	return &bucket{rate: rate, burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// take removes n tokens and returns how long to wait until the bucket is no
+// longer in debt.
+func (b *bucket) take(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// limiter caps upload and download rates. Nil limiters and buckets do not limit.
+type limiter struct{ up, down *bucket }
+
+// parseLimit parses "UP,DOWN" where each rate in bytes per second is of the
+// form RATE[:BURST] with optional K, M, G suffixes. Burst defaults to one
+// second worth of rate. Empty or zero rate means unlimited.
+func parseLimit(s string) (*limiter, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid limit %q: want UP,DOWN", s)
+	}
+	var bs [2]*bucket
+	for i, p := range parts {
+		if p == "" || p == "0" {
+			continue
+		}
+		r := strings.SplitN(p, ":", 2)
+		rate, err := parseSize(r[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit %q: %v", s, err)
+		}
+		burst := rate
+		if len(r) == 2 {
+			if burst, err = parseSize(r[1]); err != nil {
+				return nil, fmt.Errorf("invalid limit %q: %v", s, err)
+			}
+		}
+		if rate <= 0 || burst <= 0 {
+			return nil, fmt.Errorf("invalid limit %q: rate and burst must be positive", s)
+		}
+		bs[i] = newBucket(float64(rate), int(burst))
+	}
+	return &limiter{up: bs[0], down: bs[1]}, nil
+}
+
+// limit returns the buckets of one direction in ls.
+func limit(ls []*limiter, up bool) []*bucket {
+	var bs []*bucket
+	for _, l := range ls {
+		if l == nil {
+			continue
+		}
+		b := l.down
+		if up {
+			b = l.up
+		}
+		if b != nil {
+			bs = append(bs, b)
+		}
+	}
+	return bs
+}
+
+// chunk is the largest read or write allowed by bs.
+func chunk(bs []*bucket, n int) int {
+	for _, b := range bs {
+		if b.burst < n {
+			n = b.burst
+		}
+	}
+	return n
+}
+
+// wait takes n tokens from each of bs and sleeps until all of them allow.
+func wait(bs []*bucket, n int) {
+	var d time.Duration
+	for _, b := range bs {
+		if w := b.take(n); w > d {
+			d = w
+		}
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// limitConn caps a connection to the target: writes are uploads and reads
+// are downloads.
+type limitConn struct {
+	net.Conn
+	up, down []*bucket
+}
+
+func limitTarget(c net.Conn, ls ...*limiter) net.Conn {
+	up, down := limit(ls, true), limit(ls, false)
+	if len(up) == 0 && len(down) == 0 {
+		return c
+	}
+	return &limitConn{c, up, down}
+}
+
+func (c *limitConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b[:chunk(c.down, len(b))])
+	wait(c.down, n)
+	return n, err
+}
+
+func (c *limitConn) Write(b []byte) (n int, err error) {
+	for n < len(b) && err == nil {
+		var nw int
+		nw, err = c.Conn.Write(b[n : n+chunk(c.up, len(b)-n)])
+		wait(c.up, nw)
+		n += nw
+	}
+	return
+}
+
+// limitPacketConn caps a packet connection to targets like limitConn.
+type limitPacketConn struct {
+	net.PacketConn
+	up, down []*bucket
+}
+
+func limitTargetPacket(c net.PacketConn, ls ...*limiter) net.PacketConn {
+	up, down := limit(ls, true), limit(ls, false)
+	if len(up) == 0 && len(down) == 0 {
+		return c
+	}
+	return &limitPacketConn{c, up, down}
+}
+
+func (c *limitPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	wait(c.down, n)
+	return n, addr, err
+}
+
+func (c *limitPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	wait(c.up, len(b))
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// listenerLimit returns the limiter shared by all connections to the listener
+// of server URL s, given by limit=UP,DOWN.
+func listenerLimit(s string) (*limiter, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return parseLimit(u.Query().Get("limit"))
+}
+
+// per client IP limiters, shared by all connections from the same IP
+var ipLimits = struct {
+	sync.Mutex
+	spec string
+	m    map[string]*ipLimiter
+}{m: make(map[string]*ipLimiter)}
+
+type ipLimiter struct {
+	*limiter
+	refs int
+}
+
+// prepareIPLimit returns a function changing the per client IP limit for new
+// connections.
+func prepareIPLimit(spec string) (func(), error) {
+	if _, err := parseLimit(spec); err != nil {
+		return nil, err
+	}
+	return func() {
+		ipLimits.Lock()
+		defer ipLimits.Unlock()
+		if spec != ipLimits.spec {
+			ipLimits.spec = spec
+			ipLimits.m = make(map[string]*ipLimiter)
+		}
+	}, nil
+}
+
+// ipLimit returns the limiter of the client IP of addr and a function to
+// call once the connection is done.
+func ipLimit(addr net.Addr) (*limiter, func()) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, func() {}
+	}
+	ipLimits.Lock()
+	defer ipLimits.Unlock()
+	m := ipLimits.m
+	l := m[host]
+	if l == nil {
+		lim, _ := parseLimit(ipLimits.spec) // validated by prepareIPLimit
+		if lim == nil {
+			return nil, func() {}
+		}
+		l = &ipLimiter{limiter: lim}
+		m[host] = l
+	}
+	l.refs++
+	return l.limiter, func() {
+		ipLimits.Lock()
+		defer ipLimits.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(m, host)
+		}
+	}
+}
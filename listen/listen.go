@@ -49,3 +49,44 @@ func (l *targetListener) Accept() (net.Conn, error) {
 	}
 	return &targetConn{c, l.target}, nil
 }
+
+type translatedConn struct {
+	net.Conn
+	lookup func(net.IP) (string, bool)
+}
+
+func (c *translatedConn) LocalAddr() net.Addr {
+	addr := c.Conn.LocalAddr() // a SOCKS target is only known as a string
+	if addr == nil {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if domain, ok := c.lookup(ip); ok {
+			return strAddr(net.JoinHostPort(domain, port))
+		}
+	}
+	return addr
+}
+
+type translatedListener struct {
+	net.Listener
+	lookup func(net.IP) (string, bool)
+}
+
+// Translate wraps l so that connections to an IP address lookup knows a
+// domain of report the domain and port as their target.
+func Translate(l net.Listener, lookup func(net.IP) (string, bool)) net.Listener {
+	return &translatedListener{l, lookup}
+}
+
+func (l *translatedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &translatedConn{c, l.lookup}, nil
+}
@@ -0,0 +1,188 @@
+package listen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to wait for the client to send the first bytes before giving up
+// sniffing, e.g. for protocols where the server speaks first.
+const sniffTimeout = 300 * time.Millisecond
+
+const sniffMax = 16 * 1024
+
+type sniffConn struct {
+	net.Conn
+	once   sync.Once
+	target net.Addr
+	buf    []byte // peeked bytes not read yet
+}
+
+func (c *sniffConn) LocalAddr() net.Addr {
+	c.once.Do(c.sniff)
+	return c.target
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	c.once.Do(c.sniff)
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// sniff peeks at the first bytes and takes the TLS SNI or HTTP Host as the
+// target domain if there is one.
+func (c *sniffConn) sniff() {
+	c.target = c.Conn.LocalAddr()
+	tcp, ok := c.target.(*net.TCPAddr)
+	if !ok { // unknown or already a domain
+		return
+	}
+
+	buf := make([]byte, 0, sniffMax)
+	c.Conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	var host string
+	for more := true; more && len(buf) < cap(buf); {
+		n, err := c.Conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if host, more = sniffHost(buf); err != nil {
+			break
+		}
+	}
+	c.Conn.SetReadDeadline(time.Time{})
+	c.buf = buf
+
+	if host != "" && net.ParseIP(host) == nil {
+		c.target = strAddr(net.JoinHostPort(host, strconv.Itoa(tcp.Port)))
+	}
+}
+
+type sniffListener struct{ net.Listener }
+
+// Sniff wraps l so that connections report the server name of a TLS
+// ClientHello or the Host of an HTTP request they start with as their
+// target, keeping the original port. The peeked bytes are read again.
+func Sniff(l net.Listener) net.Listener { return &sniffListener{l} }
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &sniffConn{Conn: c}, nil
+}
+
+// sniffHost returns the domain in b, or whether more bytes are needed to
+// tell.
+func sniffHost(b []byte) (host string, more bool) {
+	if len(b) == 0 {
+		return "", true
+	}
+	if b[0] == 0x16 { // TLS handshake record
+		return sniffTLS(b)
+	}
+	return sniffHTTP(b)
+}
+
+func sniffTLS(b []byte) (string, bool) {
+	if len(b) < 5 {
+		return "", true
+	}
+	n := 5 + int(binary.BigEndian.Uint16(b[3:5]))
+	if len(b) < n {
+		return "", true
+	}
+	b = b[5:n]
+
+	// handshake type, length, client version and random
+	if len(b) < 38 || b[0] != 1 {
+		return "", false
+	}
+	b = b[38:]
+	skip := func(lenBytes int) bool { // skip a length-prefixed vector
+		if len(b) < lenBytes {
+			return false
+		}
+		n := 0
+		for _, x := range b[:lenBytes] {
+			n = n<<8 | int(x)
+		}
+		if len(b) < lenBytes+n {
+			return false
+		}
+		b = b[lenBytes+n:]
+		return true
+	}
+	if !skip(1) || !skip(2) || !skip(1) { // session id, cipher suites, compression methods
+		return "", false
+	}
+	if len(b) < 2 {
+		return "", false
+	}
+	b = b[2:] // extensions length
+	for len(b) >= 4 {
+		typ, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			return "", false
+		}
+		if typ == 0 { // server_name
+			ext := b[4 : 4+n]
+			if len(ext) < 2 {
+				return "", false
+			}
+			for ext = ext[2:]; len(ext) >= 3; {
+				l := int(binary.BigEndian.Uint16(ext[1:]))
+				if len(ext) < 3+l {
+					return "", false
+				}
+				if ext[0] == 0 { // host_name
+					return string(ext[3 : 3+l]), false
+				}
+				ext = ext[3+l:]
+			}
+			return "", false
+		}
+		b = b[4+n:]
+	}
+	return "", false
+}
+
+func sniffHTTP(b []byte) (string, bool) {
+	// request line starts with an uppercase method
+	i := 0
+	for i < len(b) && b[i] >= 'A' && b[i] <= 'Z' {
+		i++
+	}
+	if i == len(b) {
+		return "", i < 16
+	}
+	if i == 0 || b[i] != ' ' {
+		return "", false
+	}
+
+	end, complete := bytes.Index(b, []byte("\r\n\r\n")), true
+	if end < 0 { // only look at whole header lines
+		end, complete = bytes.LastIndex(b, []byte("\r\n")), false
+		if end < 0 {
+			return "", true
+		}
+	}
+	for _, line := range strings.Split(string(b[:end]), "\r\n")[1:] {
+		if k := strings.IndexByte(line, ':'); k > 0 && strings.EqualFold(line[:k], "host") {
+			host := strings.TrimSpace(line[k+1:])
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return strings.Trim(host, "[]"), false
+		}
+	}
+	return "", !complete
+}
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/riobard/go-shadowsocks2/core"
 	"github.com/riobard/go-shadowsocks2/listen"
+	"github.com/riobard/go-shadowsocks2/socks"
 )
 
 func main() {
@@ -18,99 +28,369 @@ func main() {
 		return
 	}
 
+	if err := config.load(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+
 	if len(config.Client) == 0 && len(config.Server) == 0 {
 		flag.Usage()
 		return
 	}
 
-	if len(config.Client) > 0 {
-		client()
+	ctx, cancel := context.WithCancel(context.Background())
+	if config.Usage != "" {
+		if err := loadUsage(config.Usage); err != nil {
+			log.Fatal(err)
+		}
+		go persistUsage(ctx, config.Usage, time.Minute)
+	}
+
+	if err := apply(ctx, &config); err != nil {
+		log.Fatal(err)
+	}
+
+	if config.Admin != "" {
+		go admin(ctx, config.Admin)
+	}
+
+	if config.Metrics != "" {
+		go serveMetrics(config.Metrics)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := reload(ctx); err != nil {
+			log.Printf("reload failed: %v", err)
+		}
+	}
+	reloading.Lock() // no more reloads from now on
+	shutdown(cancel, config.Drain)
+
+	if config.Usage != "" {
+		if err := saveUsage(config.Usage); err != nil {
+			log.Printf("failed to save usage: %v", err)
+		}
 	}
+}
+
+// serializes reloads from SIGHUP and the admin endpoint, and their updates
+// of config
+var reloading sync.Mutex
 
-	if len(config.Server) > 0 {
-		server()
+// reload re-reads the configuration and applies the changes. Settings read
+// only at startup keep their values until restart.
+func reload(ctx context.Context) error {
+	reloading.Lock()
+	defer reloading.Unlock()
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
 	}
+	logf("reloading config")
+	if err := apply(ctx, cfg); err != nil {
+		return err
+	}
+	config.Drain = cfg.Drain
+	for _, name := range fixedFlags(&config, cfg) {
+		log.Printf("reload: -%s needs a restart to change", name)
+	}
+	return nil
+}
 
-	select {}
+// fixedFlags returns the flags changed from old to new that reloading does
+// not apply.
+func fixedFlags(old, new *Config) []string {
+	var names []string
+	for _, f := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"verbose", old.Verbose, new.Verbose},
+		{"udptimeout", old.UDPTimeout, new.UDPTimeout},
+		{"admin", old.Admin, new.Admin},
+		{"metrics", old.Metrics, new.Metrics},
+		{"usage", old.Usage, new.Usage},
+	} {
+		if f.old != f.new {
+			names = append(names, f.name)
+		}
+	}
+	return names
 }
 
-func client() {
-	if len(config.UDPTun) > 0 { // use first server for UDP
-		addr, cipher, password, err := parseURL(config.Client[0])
+// client adds the services of cfg as a client to svcs, and its changes of
+// global state to p.
+func client(ctx context.Context, cfg *Config, svcs services, p *pending) error {
+	udpProbe := udpProbeDNS
+	if network, addr, err := dnsURL(cfg.DNSUpstream); err == nil && network == "udp" {
+		udpProbe = addr
+	}
+	servers, err := udpServers(cfg.Client, udpProbe)
+	if err != nil {
+		return err
+	}
+	hosts := make([]string, len(servers))
+	for i, s := range servers {
+		hosts[i] = s.host
+	}
+
+	for _, p := range cfg.UDPTun {
+		p := p
+		svcs[serviceKey{"udptun " + p[0], p[1] + " " + udpProbe + " " + cfg.Client.String()}] = func() (closer, error) {
+			if err := resolveUDPServers(servers); err != nil {
+				return nil, err
+			}
+			tgt := socks.ParseAddr(p[1])
+			if tgt == nil {
+				return nil, fmt.Errorf("invalid target address: %q", p[1])
+			}
+			c, err := net.ListenPacket("udp", p[0])
+			if err != nil {
+				return nil, err
+			}
+			logf("UDP tunnel %s <-> %s <-> %s", p[0], strings.Join(hosts, ","), p[1])
+			go udpLocal(ctx, c, servers, tgt)
+			return c, nil
+		}
+	}
+
+	if cfg.FakeIP != "" && cfg.DNS == "" {
+		return errors.New("-fakeip needs -dns")
+	}
+	commitFakeIP, err := prepareFakeIP(cfg.FakeIP)
+	if err != nil {
+		return err
+	}
+	p.add(commitFakeIP, nil)
+
+	if cfg.DNS != "" {
+		var direct []string
+		if cfg.DNSDirect != "" {
+			direct = strings.Split(cfg.DNSDirect, ",")
+		}
+		f, err := newDNSForwarder(cfg.DNSUpstream, servers, direct, cfg.DNSDirectServer)
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+		spec := strings.Join([]string{cfg.DNSUpstream, cfg.DNSDirect, cfg.DNSDirectServer, cfg.Client.String()}, " ")
+		svcs[serviceKey{"dns udp " + cfg.DNS, spec}] = func() (closer, error) {
+			if err := resolveUDPServers(servers); err != nil {
+				return nil, err
+			}
+			c, err := net.ListenPacket("udp", cfg.DNS)
+			if err != nil {
+				return nil, err
+			}
+			logf("DNS udp %s <-> %s", cfg.DNS, cfg.DNSUpstream)
+			go f.serveUDP(c)
+			return c, nil
+		}
+		svcs[serviceKey{"dns tcp " + cfg.DNS, spec}] = func() (closer, error) {
+			if !f.overTCP {
+				if err := resolveUDPServers(servers); err != nil {
+					return nil, err
+				}
+			}
+			l, err := net.Listen("tcp", cfg.DNS)
+			if err != nil {
+				return nil, err
+			}
+			logf("DNS tcp %s <-> %s", cfg.DNS, cfg.DNSUpstream)
+			go f.serveTCP(l)
+			return l, nil
 		}
+	}
 
-		ciph, err := core.PickCipher(cipher, nil, password)
+	for _, each := range cfg.Client {
+		addr, _, _, err := parseURL(each)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		for _, p := range config.UDPTun {
-			go udpLocal(p[0], addr, p[1], ciph.PacketConn)
+		name, opts, err := parsePlugin(each, cfg.Plugin, cfg.PluginOpts)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		plug, err := clientPlugin(name, opts, addr)
+		if err != nil {
+			return err
+		}
+		svcs[serviceKey{"plugin " + addr, name + ";" + opts}] = func() (closer, error) {
+			plug.start()
+			return plug, nil
 		}
 	}
 
-	d, err := fastdialer(config.Client...)
+	d, err := fastdialer(cfg)
 	if err != nil {
-		log.Fatalf("failed to create dialer: %v", err)
+		return fmt.Errorf("failed to create dialer: %v", err)
+	}
+	var probe func(net.Conn) error
+	if cfg.Probe != "" {
+		if probe, err = parseProbe(cfg.Probe); err != nil {
+			d.Close()
+			return err
+		}
 	}
+	p.add(func() {
+		if probe != nil {
+			go d.Check(ctx, cfg.ProbeInterval, func(c net.Conn) error {
+				err := probe(c)
+				if err != nil {
+					logf("health check via %v failed: %v", c.RemoteAddr(), err)
+				}
+				return err
+			})
+		}
+		if old, ok := clientDialer.v.Load().(*dialer); ok {
+			old.Close() // stop its background dials and health checks
+		}
+		clientDialer.Store(d)
+	}, func() { d.Close() })
 
-	if len(config.TCPTun) > 0 {
-		for _, p := range config.TCPTun {
+	for _, p := range cfg.TCPTun {
+		p := p
+		svcs[serviceKey{"tcptun " + p[0], p[1]}] = func() (closer, error) {
 			l, err := listen.ListenTo("tcp", p[0], p[1])
 			if err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
 			logf("tcptun %v --> %v", p[0], p[1])
-			go tcpLocal(l, d)
+			go tcpLocal(ctx, l, &clientDialer)
+			return l, nil
 		}
 	}
 
-	if config.Socks != "" {
-		l, err := listen.Listen("socks", "tcp", config.Socks)
-		if err != nil {
-			log.Fatal(err)
-		}
-		logf("socks %v", config.Socks)
-		go tcpLocal(l, d)
+	if cfg.Socks != "" {
+		svcs[serviceKey{"socks " + cfg.Socks, ""}] = localService(ctx, "socks", cfg.Socks, false)
 	}
 
-	if config.RedirTCP != "" {
-		l, err := listen.Listen("redir", "tcp", config.RedirTCP)
-		if err != nil {
-			log.Fatal(err)
-		}
-		logf("redir tcp %v", config.RedirTCP)
-		go tcpLocal(l, d)
+	if cfg.RedirTCP != "" {
+		svcs[serviceKey{"redir " + cfg.RedirTCP, fmt.Sprint(cfg.Sniff)}] = localService(ctx, "redir", cfg.RedirTCP, cfg.Sniff)
 	}
 
-	if config.TproxyTCP != "" {
-		l, err := listen.Listen("tproxy", "tcp", config.TproxyTCP)
+	if cfg.TproxyTCP != "" {
+		svcs[serviceKey{"tproxy " + cfg.TproxyTCP, fmt.Sprint(cfg.Sniff)}] = localService(ctx, "tproxy", cfg.TproxyTCP, cfg.Sniff)
+	}
+	return nil
+}
+
+func localService(ctx context.Context, kind, addr string, sniff bool) service {
+	return func() (closer, error) {
+		l, err := listen.Listen(kind, "tcp", addr)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
+		}
+		l = listen.Translate(l, fakeDomain) // from fake IPs back to domains
+		if sniff {
+			l = listen.Sniff(l) // unless already a domain
 		}
-		logf("tproxy tcp %v", config.TproxyTCP)
-		go tcpLocal(l, d)
+		logf("%s tcp %v", kind, addr)
+		go tcpLocal(ctx, l, &clientDialer)
+		return l, nil
 	}
 }
 
-func server() {
-	for _, each := range config.Server {
+// server adds the services of cfg as a server to svcs, and its changes of
+// global state to p.
+func server(ctx context.Context, cfg *Config, svcs services, p *pending) error {
+	commitIPLimit, err := prepareIPLimit(cfg.IPLimit)
+	if err != nil {
+		return err
+	}
+	p.add(commitIPLimit, nil)
+
+	commitResolver, err := prepareResolver(cfg.Resolver, cfg.ResolverPrefer)
+	if err != nil {
+		return err
+	}
+	p.add(commitResolver, nil)
+
+	nat, err := parseNATMode(cfg.UDPNAT)
+	if err != nil {
+		return err
+	}
+
+	for _, each := range cfg.Server {
 		addr, cipher, password, err := parseURL(each)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
 		ciph, err := core.PickCipher(cipher, nil, password)
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+
+		u, commitUser, err := serverUser(each, addr)
+		if err != nil {
+			return err
 		}
+		p.add(commitUser, nil)
 
-		if config.UDP {
-			go udpRemote(addr, ciph.PacketConn)
+		lim, err := listenerLimit(each)
+		if err != nil {
+			return err
+		}
+		r := &remote{user: u, lim: lim, nat: nat, udp: cfg.UDP, dialTimeout: cfg.DialTimeout, forward: cfg.Forward}
+
+		plugin, opts, err := parsePlugin(each, cfg.Plugin, cfg.PluginOpts)
+		if err != nil {
+			return err
+		}
+		tr, err := parseTransport(each)
+		if err != nil {
+			return err
+		}
+		if plugin != "" && tr.ws {
+			return fmt.Errorf("%s: plugin and WebSocket transport are exclusive", addr)
+		}
+
+		if cfg.UDP {
+			svcs[serviceKey{"udp " + addr, each + " " + cfg.UDPNAT}] = func() (closer, error) {
+				c, err := net.ListenPacket("udp", addr)
+				if err != nil {
+					return nil, err
+				}
+				logf("listening UDP on %s", addr)
+				go udpRemote(ctx, c, ciph.PacketConn, r)
+				return c, nil
+			}
+		}
+		// UDP over TCP relays with the NAT mode, if UDP is enabled
+		spec := strings.Join([]string{each, plugin + ";" + opts, cfg.UDPNAT, fmt.Sprint(cfg.UDP), cfg.DialTimeout.String(), cfg.Forward}, " ")
+		svcs[serviceKey{"tcp " + addr, spec}] = func() (closer, error) {
+			if plugin == "" {
+				l, err := net.Listen("tcp", addr)
+				if err != nil {
+					return nil, err
+				}
+				tl, err := tr.listen(l)
+				if err != nil {
+					l.Close()
+					return nil, err
+				}
+				logf("listening TCP on %s", addr)
+				go tcpRemote(ctx, tl, ciph.StreamConn, r)
+				return tl, nil
+			}
+			plug, l, err := listenPlugin(plugin, opts, addr)
+			if err != nil {
+				return nil, err
+			}
+			plug.start()
+			logf("listening TCP on %s via plugin %s", addr, plugin)
+			go tcpRemote(ctx, l, ciph.StreamConn, r)
+			return pluginListener{l, plug}, nil
 		}
-		go tcpRemote(addr, ciph.StreamConn)
 	}
+	return nil
 }
 
 func logf(f string, v ...interface{}) {
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/riobard/go-shadowsocks2/shadowaead"
+)
+
+// counter is a set of int64 values keyed by Prometheus labels.
+type counter struct{ m sync.Map }
+
+func (c *counter) get(labels string) *int64 {
+	v, ok := c.m.Load(labels)
+	if !ok {
+		v, _ = c.m.LoadOrStore(labels, new(int64))
+	}
+	return v.(*int64)
+}
+
+func (c *counter) Add(labels string, n int64) { atomic.AddInt64(c.get(labels), n) }
+
+func (c *counter) write(w io.Writer, name string, scale float64) {
+	var keys []string
+	c.m.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %g\n", name, k, float64(atomic.LoadInt64(c.get(k)))*scale)
+	}
+}
+
+var metrics struct {
+	bytes      counter // by proto, mode and direction
+	dialNanos  counter // by target
+	dials      counter // by target
+	dialErrors counter // by target
+	udpDrops   counter // by mode and reason
+}
+
+func byteLabels(proto, mode, direction string) string {
+	return fmt.Sprintf("proto=%q,mode=%q,direction=%q", proto, mode, direction)
+}
+
+// observeDial records latency and outcome of a dial to target.
+func observeDial(target string, t0 time.Time, err error) {
+	k := fmt.Sprintf("target=%q", target)
+	metrics.dials.Add(k, 1)
+	metrics.dialNanos.Add(k, time.Since(t0).Nanoseconds())
+	if err != nil {
+		metrics.dialErrors.Add(k, 1)
+	}
+}
+
+// most distinct targets labeled in dial metrics of the server
+const maxTargetLabels = 256
+
+var targetLabels = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// targetLabel returns host as a label of dial metrics, or "other" once
+// maxTargetLabels hosts are labeled already.
+func targetLabel(host string) string {
+	targetLabels.Lock()
+	defer targetLabels.Unlock()
+	if !targetLabels.m[host] && len(targetLabels.m) >= maxTargetLabels {
+		return "other"
+	}
+	targetLabels.m[host] = true
+	return host
+}
+
+// countConn counts bytes read from and written to the embedded net.Conn.
+type countConn struct {
+	net.Conn
+	rx, tx *int64
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.rx, int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.tx, int64(n))
+	return n, err
+}
+
+// countBytes wraps the plaintext side c of a relay to count its traffic.
+func countBytes(c net.Conn, mode string) net.Conn {
+	up := metrics.bytes.get(byteLabels("tcp", mode, "upload"))
+	down := metrics.bytes.get(byteLabels("tcp", mode, "download"))
+	if mode == "server" { // c is connected to the target
+		return &countConn{c, down, up}
+	}
+	return &countConn{c, up, down} // c is connected to the user
+}
+
+func writeMetrics(w io.Writer) {
+	gauge := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+	}
+	header := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	gauge("shadowsocks_tcp_relays", "Number of active TCP relays.", atomic.LoadInt64(&inflight.relays))
+	header("shadowsocks_udp_nat_sessions", "gauge", "Number of entries in the UDP NAT table.")
+	fmt.Fprintf(w, "shadowsocks_udp_nat_sessions{mode=\"client\"} %d\n", atomic.LoadInt64(&inflight.udpLocal))
+	fmt.Fprintf(w, "shadowsocks_udp_nat_sessions{mode=\"server\"} %d\n", atomic.LoadInt64(&inflight.udpRemote))
+
+	gauge("shadowsocks_udp_queued_packets", "Number of UDP packets queued across all sessions.", atomic.LoadInt64(&udpQueued))
+	header("shadowsocks_udp_dropped_total", "counter", "UDP packets dropped because a session queue was full or memory ran out.")
+	metrics.udpDrops.write(w, "shadowsocks_udp_dropped_total", 1)
+
+	header("shadowsocks_bytes_total", "counter", "Plaintext bytes relayed.")
+	metrics.bytes.write(w, "shadowsocks_bytes_total", 1)
+
+	header("shadowsocks_dial_seconds", "summary", "Latency of dials to servers (client) or targets (server).")
+	metrics.dialNanos.write(w, "shadowsocks_dial_seconds_sum", 1e-9)
+	metrics.dials.write(w, "shadowsocks_dial_seconds_count", 1)
+	header("shadowsocks_dial_errors_total", "counter", "Failed dials.")
+	metrics.dialErrors.write(w, "shadowsocks_dial_errors_total", 1)
+
+	stream, packet := shadowaead.AuthFailures()
+	header("shadowsocks_auth_failures_total", "counter", "Records and packets failing authentication.")
+	fmt.Fprintf(w, "shadowsocks_auth_failures_total{kind=\"stream\"} %d\n", stream)
+	fmt.Fprintf(w, "shadowsocks_auth_failures_total{kind=\"packet\"} %d\n", packet)
+
+	if d, ok := clientDialer.v.Load().(*dialer); ok {
+		stats := d.Stats()
+		header("shadowsocks_server_latency_seconds", "gauge", "Smoothed dial latency of each client server.")
+		for i, s := range stats {
+			fmt.Fprintf(w, "shadowsocks_server_latency_seconds{server=%q} %g\n", d.addrs[i], s.Latency.Seconds())
+		}
+		header("shadowsocks_server_inflight_dials", "gauge", "Number of inflight dials to each client server.")
+		for i, s := range stats {
+			fmt.Fprintf(w, "shadowsocks_server_inflight_dials{server=%q} %d\n", d.addrs[i], s.Inflight)
+		}
+		header("shadowsocks_server_active_conns", "gauge", "Number of open connections through each client server.")
+		for i, s := range stats {
+			fmt.Fprintf(w, "shadowsocks_server_active_conns{server=%q} %d\n", d.addrs[i], s.Active)
+		}
+		header("shadowsocks_server_breaker_state", "gauge", "Circuit breaker of each client server: 0 closed, 1 open, 2 half-open.")
+		for i, s := range stats {
+			fmt.Fprintf(w, "shadowsocks_server_breaker_state{server=%q} %d\n", d.addrs[i], s.Breaker)
+		}
+		header("shadowsocks_server_dial_failures_total", "counter", "Failed dials to each client server.")
+		for i, s := range stats {
+			fmt.Fprintf(w, "shadowsocks_server_dial_failures_total{server=%q} %d\n", d.addrs[i], s.Failures)
+		}
+		header("shadowsocks_server_healthy", "gauge", "Whether the last health check of each client server passed.")
+		for i, s := range stats {
+			fmt.Fprintf(w, "shadowsocks_server_healthy{server=%q} %d\n", d.addrs[i], b2i(s.Healthy))
+		}
+		header("shadowsocks_server_probe_seconds", "gauge", "Round trip of the last passed health check of each client server.")
+		for i, s := range stats {
+			fmt.Fprintf(w, "shadowsocks_server_probe_seconds{server=%q} %g\n", d.addrs[i], s.RTT.Seconds())
+		}
+	}
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	logf("metrics %v", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,252 @@
+// Package mux multiplexes streams over a single connection, with per-stream
+// flow control and half-close.
+//
+// Each frame starts with a 7-byte header: a type byte, a 4-byte big-endian
+// stream ID and a 2-byte big-endian payload length. Clients open streams of
+// odd IDs, servers of even IDs.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	typeSYN    = iota // open a stream
+	typeData          // payload for a stream
+	typeWindow        // 4-byte increment of the send window of a stream
+	typeFIN           // no more data from the sender
+	typeRST           // abort a stream
+)
+
+const (
+	headerSize    = 7
+	maxPayload    = 1<<16 - 1
+	initialWindow = 256 * 1024
+	acceptBacklog = 256
+)
+
+var (
+	// ErrClosed means that the session is closed.
+	ErrClosed = errors.New("mux: session closed")
+	// ErrReset means that the peer aborted the stream.
+	ErrReset    = errors.New("mux: stream reset")
+	errProtocol = errors.New("mux: protocol error")
+)
+
+// Session carries streams over a connection.
+type Session struct {
+	conn        net.Conn
+	idleTimeout time.Duration
+
+	wmu sync.Mutex // serializes frames
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	idle    *time.Timer
+	err     error
+
+	accept chan *Stream
+	closed chan struct{}
+}
+
+// Client starts a session over c for opening streams.
+func Client(c net.Conn) *Session { return newSession(c, 1) }
+
+// Server starts a session over c for accepting streams.
+func Server(c net.Conn) *Session { return newSession(c, 2) }
+
+func newSession(c net.Conn, firstID uint32) *Session {
+	s := &Session{
+		conn:    c,
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+		accept:  make(chan *Stream, acceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	go s.recvLoop()
+	return s
+}
+
+// SetIdleTimeout makes s close itself once it has had no streams for d.
+func (s *Session) SetIdleTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idleTimeout = d
+	s.resetIdle()
+}
+
+// resetIdle restarts the idle timer if there are no streams. Caller must
+// hold s.mu.
+func (s *Session) resetIdle() {
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	if s.idleTimeout > 0 && len(s.streams) == 0 {
+		s.idle = time.AfterFunc(s.idleTimeout, func() {
+			s.mu.Lock()
+			idle := len(s.streams) == 0
+			s.mu.Unlock()
+			if idle {
+				s.Close()
+			}
+		})
+	}
+}
+
+// Open opens a new stream.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := s.add(id)
+	s.mu.Unlock()
+
+	if err := s.writeFrame(typeSYN, id, nil); err != nil {
+		st.remove()
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the next stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.closed:
+		return nil, s.err
+	}
+}
+
+// NumStreams returns the number of streams open.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// IsClosed reports whether s is closed.
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the connection and all streams.
+func (s *Session) Close() error { return s.closeWith(ErrClosed) }
+
+func (s *Session) closeWith(err error) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.err = err
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+	close(s.closed)
+	s.mu.Unlock()
+	return s.conn.Close()
+}
+
+// add registers a new stream. Caller must hold s.mu.
+func (s *Session) add(id uint32) *Stream {
+	st := newStream(s, id)
+	s.streams[id] = st
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	return st
+}
+
+func (s *Session) writeFrame(typ byte, id uint32, payload []byte) error {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], id)
+	binary.BigEndian.PutUint16(buf[5:], uint16(len(payload)))
+	copy(buf[headerSize:], payload)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.IsClosed() {
+		return s.err
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		s.closeWith(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	var h [headerSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, h[:]); err != nil {
+			s.closeWith(err)
+			return
+		}
+		typ, id, n := h[0], binary.BigEndian.Uint32(h[1:]), int(binary.BigEndian.Uint16(h[5:]))
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.closeWith(err)
+			return
+		}
+
+		s.mu.Lock()
+		st := s.streams[id]
+		if typ == typeSYN && st == nil && id%2 != s.nextID%2 {
+			st = s.add(id)
+			select {
+			case s.accept <- st:
+			default: // backlog full
+				st = nil
+				delete(s.streams, id)
+				s.resetIdle()
+				go s.writeFrame(typeRST, id, nil)
+			}
+			s.mu.Unlock()
+			continue
+		}
+		s.mu.Unlock()
+		if st == nil {
+			continue // frames of streams already gone
+		}
+
+		switch typ {
+		case typeData:
+			if !st.push(payload) {
+				s.closeWith(errProtocol)
+				return
+			}
+		case typeWindow:
+			if len(payload) != 4 {
+				s.closeWith(errProtocol)
+				return
+			}
+			st.grant(binary.BigEndian.Uint32(payload))
+		case typeFIN:
+			st.finish()
+		case typeRST:
+			st.reset()
+		default:
+			s.closeWith(errProtocol)
+			return
+		}
+	}
+}
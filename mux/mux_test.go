@@ -0,0 +1,168 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// pair returns a client and a server session connected over loopback TCP.
+func pair(t *testing.T) (*Session, *Session) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := Client(c), Server(sc)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func accept(t *testing.T, s *Session) *Stream {
+	st, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	client, server := pair(t)
+	go func() { // echo each stream until FIN
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer st.Close()
+				io.Copy(st, st)
+			}()
+		}
+	}()
+
+	msg := bytes.Repeat([]byte("0123456789"), 100000) // beyond the window
+	for i := 0; i < 3; i++ {
+		st, err := client.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			st.Write(msg)
+			st.CloseWrite()
+		}()
+		st.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, err := io.ReadAll(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("stream %d: got %d bytes back, want %d", i, len(got), len(msg))
+		}
+		st.Close()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for client.NumStreams() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := client.NumStreams(); n != 0 {
+		t.Errorf("%d streams left open", n)
+	}
+}
+
+func TestWindowExhaustion(t *testing.T) {
+	client, server := pair(t)
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Write([]byte{0}); err != nil { // to let the server accept
+		t.Fatal(err)
+	}
+	peer := accept(t, server)
+
+	// the peer reads nothing, so writes stop once the window is used up
+	st.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := st.Write(make([]byte, initialWindow))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write beyond the window: %v", err)
+	}
+	if n != initialWindow-1 {
+		t.Fatalf("wrote %d bytes beyond the window, want %d", n, initialWindow-1)
+	}
+
+	// reading grants the window again
+	st.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	done := make(chan error, 1)
+	go func() {
+		_, err := st.Write(make([]byte, initialWindow))
+		done <- err
+	}()
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(peer, make([]byte, 2*initialWindow)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	client, server := pair(t)
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Write([]byte("unread")); err != nil {
+		t.Fatal(err)
+	}
+	peer := accept(t, server)
+
+	// closing with data unread resets the stream on both ends
+	deadline := time.Now().Add(time.Second)
+	for {
+		peer.mu.Lock()
+		n := peer.buf.Len()
+		peer.mu.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	peer.Close()
+
+	st.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, ErrReset) {
+		t.Fatalf("read of a reset stream: %v", err)
+	}
+	if _, err := st.Write([]byte("more")); !errors.Is(err, ErrReset) {
+		t.Fatalf("write to a reset stream: %v", err)
+	}
+	if n := client.NumStreams(); n != 0 {
+		t.Errorf("%d streams left after reset", n)
+	}
+
+	// the session carries on
+	st, err = client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Write([]byte("x"))
+	accept(t, server)
+}
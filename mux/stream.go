@@ -0,0 +1,318 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a logical connection within a Session.
+type Stream struct {
+	s  *Session
+	id uint32
+
+	mu         sync.Mutex
+	buf        bytes.Buffer // received and not read yet
+	recvWindow int          // bytes the peer may still send
+	consumed   int          // bytes read since the last window update
+	sendWindow int          // bytes that may still be sent
+	finRecv    bool
+	finSent    bool
+	closed     bool // by Close
+	rst        bool // by the peer
+
+	readable chan struct{} // signaled when buf grows or the stream ends
+	writable chan struct{} // signaled when sendWindow grows or the stream ends
+
+	rdl, wdl deadline
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		s:          s,
+		id:         id,
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		rdl:        makeDeadline(),
+		wdl:        makeDeadline(),
+	}
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// push appends data from the peer, reporting false if it exceeds the window.
+func (st *Stream) push(b []byte) bool {
+	st.mu.Lock()
+	if len(b) > st.recvWindow {
+		st.mu.Unlock()
+		return false
+	}
+	st.recvWindow -= len(b)
+	if st.closed { // nobody will read it, as in TCP
+		st.mu.Unlock()
+		go st.abort() // not to block receiving on sending
+		return true
+	}
+	st.buf.Write(b)
+	st.mu.Unlock()
+	signal(st.readable)
+	return true
+}
+
+func (st *Stream) grant(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += int(n)
+	st.mu.Unlock()
+	signal(st.writable)
+}
+
+func (st *Stream) finish() {
+	st.mu.Lock()
+	st.finRecv = true
+	done := st.finSent
+	st.mu.Unlock()
+	signal(st.readable)
+	if done {
+		st.remove()
+	}
+}
+
+func (st *Stream) reset() {
+	st.mu.Lock()
+	st.rst = true
+	st.mu.Unlock()
+	signal(st.readable)
+	signal(st.writable)
+	st.remove()
+}
+
+// remove unregisters st from its session.
+func (st *Stream) remove() {
+	s := st.s
+	s.mu.Lock()
+	if s.streams[st.id] == st {
+		delete(s.streams, st.id)
+		s.resetIdle()
+	}
+	s.mu.Unlock()
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		case st.buf.Len() > 0:
+			n, _ := st.buf.Read(b)
+			st.consumed += n
+			var inc int
+			if st.consumed >= initialWindow/2 {
+				inc, st.consumed = st.consumed, 0
+				st.recvWindow += inc
+			}
+			st.mu.Unlock()
+			if inc > 0 {
+				var p [4]byte
+				binary.BigEndian.PutUint32(p[:], uint32(inc))
+				st.s.writeFrame(typeWindow, st.id, p[:])
+			}
+			return n, nil
+		case st.finRecv:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.rst:
+			st.mu.Unlock()
+			return 0, ErrReset
+		}
+		st.mu.Unlock()
+
+		select {
+		case <-st.readable:
+		case <-st.rdl.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-st.s.closed:
+			st.mu.Lock()
+			pending := st.buf.Len() > 0
+			st.mu.Unlock()
+			if !pending {
+				return 0, st.s.err
+			}
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.closed || st.finSent:
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		case st.rst:
+			st.mu.Unlock()
+			return written, ErrReset
+		}
+		n := st.sendWindow
+		if n > len(b) {
+			n = len(b)
+		}
+		if n > maxPayload {
+			n = maxPayload
+		}
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if n == 0 {
+			select {
+			case <-st.writable:
+				continue
+			case <-st.wdl.wait():
+				return written, os.ErrDeadlineExceeded
+			case <-st.s.closed:
+				return written, st.s.err
+			}
+		}
+		if err := st.s.writeFrame(typeData, st.id, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer no more data will be sent. Reading goes on.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.finSent || st.rst {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finRecv
+	st.mu.Unlock()
+	err := st.s.writeFrame(typeFIN, st.id, nil)
+	if done {
+		st.remove()
+	}
+	return err
+}
+
+// Close closes both directions. Like TCP, the stream is reset if data
+// received is left unread.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	unread := st.buf.Len() > 0
+	st.buf.Reset()
+	st.mu.Unlock()
+	signal(st.readable)
+	signal(st.writable)
+
+	if unread {
+		return st.abort()
+	}
+	return st.CloseWrite()
+}
+
+// abort resets the stream on both ends.
+func (st *Stream) abort() error {
+	st.mu.Lock()
+	if st.rst {
+		st.mu.Unlock()
+		return nil
+	}
+	st.rst = true
+	st.mu.Unlock()
+	st.remove()
+	return st.s.writeFrame(typeRST, st.id, nil)
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return st.s.conn.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr { return st.s.conn.RemoteAddr() }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.rdl.set(t)
+	st.wdl.set(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.rdl.set(t)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.wdl.set(t)
+	return nil
+}
+
+// deadline is a channel closed once a settable time passes, as in net.Pipe.
+type deadline struct {
+	mu     *sync.Mutex
+	timer  **time.Timer
+	cancel *chan struct{}
+}
+
+func makeDeadline() deadline {
+	c := make(chan struct{})
+	var t *time.Timer
+	return deadline{&sync.Mutex{}, &t, &c}
+}
+
+func (d deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if *d.timer != nil && !(*d.timer).Stop() {
+		<-*d.cancel // wait for the timer callback to finish and close cancel
+	}
+	*d.timer = nil
+
+	closed := false
+	select {
+	case <-*d.cancel:
+		closed = true
+	default:
+	}
+	if t.IsZero() {
+		if closed {
+			*d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			*d.cancel = make(chan struct{})
+		}
+		c := *d.cancel
+		*d.timer = time.AfterFunc(dur, func() { close(c) })
+		return
+	}
+	if !closed {
+		close(*d.cancel)
+	}
+}
+
+func (d deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return *d.cancel
+}
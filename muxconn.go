@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/riobard/go-shadowsocks2/mux"
+	"github.com/riobard/go-shadowsocks2/socks"
+)
+
+// muxTarget is the reserved target address of a connection carrying
+// multiplexed streams, each starting with its own target address.
+var muxTarget = socks.ParseAddr("mux.invalid:0")
+
+const (
+	muxIdleTimeout = time.Minute      // before a session without streams is closed
+	muxDialTimeout = 10 * time.Second // of a new session
+)
+
+// muxPool opens streams over a few long-lived sessions to the servers.
+type muxPool struct {
+	dial    func(ctx context.Context) (net.Conn, error)
+	streams int // at most per session
+
+	mu       sync.Mutex
+	sessions []*mux.Session
+	opening  map[*mux.Session]int // streams reserved but not opened yet
+}
+
+// open opens a stream on the least busy session, dialing a new session if
+// all are full. The session outlives ctx, so it is dialed with its own
+// timeout instead.
+func (p *muxPool) open(ctx context.Context) (net.Conn, error) {
+	p.mu.Lock()
+	if p.opening == nil {
+		p.opening = make(map[*mux.Session]int)
+	}
+	var best *mux.Session
+	bestN := p.streams
+	live := p.sessions[:0]
+	for _, s := range p.sessions {
+		if s.IsClosed() {
+			continue
+		}
+		live = append(live, s)
+		if n := s.NumStreams() + p.opening[s]; n < bestN {
+			best, bestN = s, n
+		}
+	}
+	for i := len(live); i < len(p.sessions); i++ {
+		p.sessions[i] = nil
+	}
+	p.sessions = live
+	if best != nil {
+		p.opening[best]++
+	}
+	p.mu.Unlock()
+
+	if best == nil {
+		dctx, cancel := context.WithTimeout(context.Background(), muxDialTimeout)
+		c, err := p.dial(dctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.Write(muxTarget); err != nil {
+			c.Close()
+			return nil, err
+		}
+		best = mux.Client(c)
+		best.SetIdleTimeout(muxIdleTimeout)
+		p.mu.Lock()
+		p.sessions = append(p.sessions, best)
+		p.opening[best]++
+		p.mu.Unlock()
+	}
+	defer func() {
+		p.mu.Lock()
+		if p.opening[best]--; p.opening[best] == 0 {
+			delete(p.opening, best)
+		}
+		p.mu.Unlock()
+	}()
+	return best.Open()
+}
+
+// muxRemote serves the streams a client multiplexes over c.
+func muxRemote(ctx context.Context, c net.Conn, r *remote) {
+	s := mux.Server(c)
+	defer s.Close()
+	for {
+		st, err := s.Accept()
+		if err != nil {
+			if !errors.Is(err, mux.ErrClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logf("mux session from %v: %v", c.RemoteAddr(), err)
+			}
+			return
+		}
+		go func() {
+			defer st.Close()
+			if err := r.user.check(); err != nil {
+				log.Printf("reject %v: %v", c.RemoteAddr(), err)
+				return
+			}
+			r.serve(ctx, st, false)
+		}()
+	}
+}
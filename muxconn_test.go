@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/riobard/go-shadowsocks2/mux"
+)
+
+func TestMuxPoolStreams(t *testing.T) {
+	var mu sync.Mutex
+	var servers []*mux.Session
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, s := range servers {
+			s.Close()
+		}
+	}()
+	dial := func(ctx context.Context) (net.Conn, error) {
+		c, sc := net.Pipe()
+		go func() {
+			if _, err := io.ReadFull(sc, make([]byte, len(muxTarget))); err != nil {
+				return
+			}
+			s := mux.Server(sc)
+			mu.Lock()
+			servers = append(servers, s)
+			mu.Unlock()
+			for {
+				if _, err := s.Accept(); err != nil {
+					return
+				}
+			}
+		}()
+		return c, nil
+	}
+
+	const streams, n = 4, 64
+	p := &muxPool{dial: dial, streams: streams}
+	if _, err := p.open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.open(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, s := range p.sessions {
+		if k := s.NumStreams(); k > streams {
+			t.Errorf("session carries %d streams, want at most %d", k, streams)
+		}
+		total += s.NumStreams()
+	}
+	if total != n {
+		t.Errorf("%d streams opened, want %d", total, n)
+	}
+	for _, s := range p.sessions {
+		s.Close()
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// NAT filtering behaviors of udpRemote as defined in RFC 4787 section 5.
+// Mapping is always endpoint-independent: each client gets one outbound
+// socket regardless of the targets it sends to.
+type natMode int
+
+const (
+	natFull           natMode = iota // endpoint-independent filtering
+	natRestricted                    // address-dependent filtering
+	natPortRestricted                // address and port-dependent filtering
+)
+
+func parseNATMode(s string) (natMode, error) {
+	switch s {
+	case "", "full":
+		return natFull, nil
+	case "restricted":
+		return natRestricted, nil
+	case "portrestricted":
+		return natPortRestricted, nil
+	}
+	return 0, fmt.Errorf("invalid UDP NAT mode %q", s)
+}
+
+// natConn drops packets from remotes the session has not sent to.
+type natConn struct {
+	net.PacketConn
+	mode natMode
+	sync.Mutex
+	allowed map[string]struct{}
+}
+
+// filterNAT wraps the outbound socket of a session to filter per mode.
+func filterNAT(c net.PacketConn, mode natMode) net.PacketConn {
+	if mode == natFull {
+		return c
+	}
+	return &natConn{PacketConn: c, mode: mode, allowed: make(map[string]struct{})}
+}
+
+func (c *natConn) key(addr net.Addr) string {
+	if c.mode == natRestricted {
+		if a, ok := addr.(*net.UDPAddr); ok {
+			return a.IP.String()
+		}
+	}
+	return addr.String()
+}
+
+func (c *natConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.Lock()
+	c.allowed[c.key(addr)] = struct{}{}
+	c.Unlock()
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *natConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		c.Lock()
+		_, ok := c.allowed[c.key(addr)]
+		c.Unlock()
+		if ok {
+			return n, addr, err
+		}
+		logf("UDP NAT filtered packet from %v", addr)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pluginRestartDelay = time.Second     // before restarting a plugin that exited
+	pluginStopGrace    = 5 * time.Second // for a plugin to exit once terminated before it is killed
+	pluginListenTries  = 3               // of free ports taken before listening
+)
+
+// plugin runs a SIP003 plugin process, which relays between remote and
+// local, restarting it whenever it exits. Once closed, it keeps running until
+// the connections through it are done, as they end with it.
+type plugin struct {
+	name, opts string
+	remote     string // server address
+	listens    bool   // on local, as client plugins do
+
+	mu     sync.Mutex
+	local  string             // where the plugin serves for the client or reaches the server
+	cancel context.CancelFunc // nil until started
+	closed bool
+	conns  int // through the plugin, not closed yet
+	done   chan struct{}
+}
+
+// plugins started and not stopped yet, to stop on shutdown
+var livePlugins = struct {
+	sync.Mutex
+	m map[*plugin]bool
+}{m: make(map[*plugin]bool)}
+
+// parsePlugin returns the plugin of URL s in SIP002 form (plugin=name;opts),
+// or name and opts if s has none.
+func parsePlugin(s, name, opts string) (string, string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	q, err := url.ParseQuery(strings.ReplaceAll(u.RawQuery, ";", "%3B")) // unless escaped as SIP002 requires
+	if err != nil {
+		return "", "", err
+	}
+	p := q.Get("plugin")
+	if p == "" {
+		return name, opts, nil
+	}
+	if i := strings.IndexByte(p, ';'); i >= 0 {
+		return p[:i], p[i+1:], nil
+	}
+	return p, "", nil
+}
+
+// newPlugin prepares plugin name for remote on a free local port.
+func newPlugin(name, opts, remote string) (*plugin, error) {
+	local, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	return &plugin{name: name, opts: opts, remote: remote, local: local, done: make(chan struct{})}, nil
+}
+
+// listenPlugin prepares plugin name for remote on a free local port and
+// listens there for the plugin, trying another port if the free one gets
+// taken first.
+func listenPlugin(name, opts, remote string) (*plugin, net.Listener, error) {
+	var err error
+	for i := 0; i < pluginListenTries; i++ {
+		var p *plugin
+		if p, err = newPlugin(name, opts, remote); err != nil {
+			return nil, nil, err
+		}
+		var l net.Listener
+		if l, err = net.Listen("tcp", p.local); err == nil {
+			return p, l, nil
+		}
+	}
+	return nil, nil, err
+}
+
+func freePort() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// client plugins by name, options and server, kept across reloads
+var clientPlugins = struct {
+	sync.Mutex
+	m map[string]*plugin
+}{m: make(map[string]*plugin)}
+
+// clientPlugin returns the plugin to reach the server at remote, the one
+// already running if unchanged.
+func clientPlugin(name, opts, remote string) (*plugin, error) {
+	k := strings.Join([]string{name, opts, remote}, ";")
+	clientPlugins.Lock()
+	defer clientPlugins.Unlock()
+	if p := clientPlugins.m[k]; p != nil {
+		return p, nil
+	}
+	p, err := newPlugin(name, opts, remote)
+	if err != nil {
+		return nil, err
+	}
+	p.listens = true
+	clientPlugins.m[k] = p
+	return p, nil
+}
+
+func (p *plugin) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil || p.closed {
+		return
+	}
+	var ctx context.Context
+	ctx, p.cancel = context.WithCancel(context.Background())
+	livePlugins.Lock()
+	livePlugins.m[p] = true
+	livePlugins.Unlock()
+	go p.run(ctx)
+}
+
+// addr returns where the plugin serves for the client or reaches the server.
+func (p *plugin) addr() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.local
+}
+
+// rebind moves a plugin listening on local to another free port if local was
+// taken meanwhile, which the plugin would fail to listen on.
+func (p *plugin) rebind() {
+	local := p.addr()
+	l, err := net.Listen("tcp", local)
+	if err == nil {
+		l.Close()
+		return
+	}
+	moved, err := freePort()
+	if err != nil {
+		logf("plugin %s: %v", p.name, err)
+		return
+	}
+	logf("plugin %s: %s taken, moving to %s", p.name, local, moved)
+	p.mu.Lock()
+	p.local = moved
+	p.mu.Unlock()
+}
+
+func (p *plugin) run(ctx context.Context) {
+	defer close(p.done)
+	rhost, rport, _ := net.SplitHostPort(p.remote)
+	if rhost == "" {
+		rhost = "0.0.0.0"
+	}
+	for {
+		if p.listens {
+			p.rebind()
+		}
+		local := p.addr()
+		lhost, lport, _ := net.SplitHostPort(local)
+		cmd := exec.Command(p.name)
+		cmd.Env = append(os.Environ(),
+			"SS_REMOTE_HOST="+rhost, "SS_REMOTE_PORT="+rport,
+			"SS_LOCAL_HOST="+lhost, "SS_LOCAL_PORT="+lport,
+			"SS_PLUGIN_OPTIONS="+p.opts)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		logf("plugin %s %s <-> %s", p.name, p.remote, local)
+		err := cmd.Start()
+		if err == nil {
+			exited := make(chan error, 1)
+			go func() { exited <- cmd.Wait() }()
+			select {
+			case err = <-exited:
+			case <-ctx.Done():
+				stopPlugin(cmd.Process, exited)
+				return
+			}
+		}
+		logf("plugin %s exited: %v", p.name, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pluginRestartDelay):
+		}
+	}
+}
+
+// stopPlugin terminates a plugin process, killing it unless it exits within
+// pluginStopGrace.
+func stopPlugin(proc *os.Process, exited <-chan error) {
+	if err := terminate(proc); err == nil {
+		select {
+		case <-exited:
+			return
+		case <-time.After(pluginStopGrace):
+			logf("plugin %d still running, killing it", proc.Pid)
+		}
+	}
+	proc.Kill()
+	<-exited
+}
+
+// Close stops the plugin and waits for it to exit, or lets it run until the
+// connections through it are done if any.
+func (p *plugin) Close() error {
+	clientPlugins.Lock()
+	for k, q := range clientPlugins.m {
+		if q == p {
+			delete(clientPlugins.m, k)
+		}
+	}
+	clientPlugins.Unlock()
+	p.mu.Lock()
+	p.closed = true
+	n := p.conns
+	p.mu.Unlock()
+	if n > 0 {
+		logf("plugin %s %s stops once %d connections are done", p.name, p.remote, n)
+		return nil
+	}
+	p.stop()
+	return nil
+}
+
+// stop stops the plugin process and waits for it to exit.
+func (p *plugin) stop() {
+	p.mu.Lock()
+	p.closed = true
+	cancel := p.cancel
+	p.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-p.done
+	}
+	livePlugins.Lock()
+	delete(livePlugins.m, p)
+	livePlugins.Unlock()
+}
+
+// stopPlugins stops all plugins, whether closed or not.
+func stopPlugins() {
+	livePlugins.Lock()
+	ps := make([]*plugin, 0, len(livePlugins.m))
+	for p := range livePlugins.m {
+		ps = append(ps, p)
+	}
+	livePlugins.Unlock()
+	for _, p := range ps {
+		p.stop()
+	}
+}
+
+// track wraps c, a connection through p, to keep p running until c closes.
+func (p *plugin) track(c net.Conn) net.Conn {
+	p.mu.Lock()
+	p.conns++
+	p.mu.Unlock()
+	return &pluginConn{Conn: c, p: p}
+}
+
+// dial connects to a client plugin with dial.
+func (p *plugin) dial(ctx context.Context, dial func(context.Context, string) (net.Conn, error)) (net.Conn, error) {
+	c, err := dial(ctx, p.addr())
+	if err != nil {
+		return nil, err
+	}
+	return p.track(c), nil
+}
+
+// pluginConn is a connection through a plugin.
+type pluginConn struct {
+	net.Conn
+	p    *plugin
+	once sync.Once
+}
+
+func (c *pluginConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		p := c.p
+		p.mu.Lock()
+		p.conns--
+		last := p.closed && p.conns == 0
+		p.mu.Unlock()
+		if last {
+			go p.stop()
+		}
+	})
+	return err
+}
+
+// pluginListener accepts connections through its plugin, which stops once
+// the listener is closed and they are done.
+type pluginListener struct {
+	net.Listener
+	p *plugin
+}
+
+func (l pluginListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.p.track(c), nil
+}
+
+func (l pluginListener) Close() error {
+	err := l.Listener.Close()
+	l.p.Close()
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// terminate asks a plugin process to exit.
+func terminate(p *os.Process) error { return p.Signal(syscall.SIGTERM) }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testPlugin is the path of testdata/fwdplugin built by TestMain.
+var testPlugin string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "plugin")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	testPlugin = filepath.Join(dir, "fwdplugin")
+	if runtime.GOOS == "windows" {
+		testPlugin += ".exe"
+	}
+	out, err := exec.Command("go", "build", "-o", testPlugin, "./testdata/fwdplugin").CombinedOutput()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to build test plugin: %v\n%s", err, out)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// echoServer echoes connections to the returned address until the test ends.
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// roundTrip reports whether a message comes back through addr.
+func roundTrip(addr string) error {
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return roundTripConn(c)
+}
+
+// roundTripConn reports whether a message written to c comes back.
+func roundTripConn(c net.Conn) error {
+	c.SetDeadline(time.Now().Add(time.Second))
+	msg := []byte("ping")
+	if _, err := c.Write(msg); err != nil {
+		return err
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, msg) {
+		return fmt.Errorf("got %q back", buf)
+	}
+	return nil
+}
+
+// eventually retries f until it succeeds or timeout passes.
+func eventually(t *testing.T, timeout time.Duration, f func() error) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := f()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// readPID returns the process ID the plugin wrote to file.
+func readPID(file string) (int, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(b))
+}
+
+func TestPluginRoundTrip(t *testing.T) {
+	p, err := clientPlugin(testPlugin, "", echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, _ := clientPlugin(testPlugin, "", p.remote); q != p {
+		t.Error("plugin of the same server not reused")
+	}
+	p.start()
+	eventually(t, 5*time.Second, func() error { return roundTrip(p.addr()) })
+
+	p.Close()
+	if err := roundTrip(p.addr()); err == nil {
+		t.Error("plugin still serving after closed")
+	}
+	if q, _ := clientPlugin(testPlugin, "", p.remote); q == p {
+		t.Error("closed plugin reused")
+	}
+}
+
+func TestPluginRestart(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	p, err := clientPlugin(testPlugin, "pid="+pidFile, echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.start()
+	eventually(t, 5*time.Second, func() error { return roundTrip(p.addr()) })
+
+	pid, err := readPID(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proc.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 5*time.Second, func() error {
+		if n, _ := readPID(pidFile); n == pid {
+			return fmt.Errorf("plugin %d not restarted", pid)
+		}
+		return roundTrip(p.addr())
+	})
+}
+
+func TestPluginStop(t *testing.T) {
+	dir := t.TempDir()
+	pidFile, termFile := filepath.Join(dir, "pid"), filepath.Join(dir, "term")
+	p, err := clientPlugin(testPlugin, "pid="+pidFile+";term="+termFile, echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.start()
+	eventually(t, 5*time.Second, func() error {
+		_, err := readPID(pidFile)
+		return err
+	})
+
+	t0 := time.Now()
+	p.Close()
+	if d := time.Since(t0); d >= pluginStopGrace {
+		t.Errorf("plugin took %v to stop", d)
+	}
+	if runtime.GOOS != "windows" { // killed right away there
+		if _, err := os.Stat(termFile); err != nil {
+			t.Errorf("plugin not terminated gracefully: %v", err)
+		}
+	}
+}
+
+func TestPluginRebind(t *testing.T) {
+	p, err := clientPlugin(testPlugin, "", echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	taken := p.addr()
+	l, err := net.Listen("tcp", taken) // by someone else before the plugin
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	p.start()
+	eventually(t, 5*time.Second, func() error { return roundTrip(p.addr()) })
+	if p.addr() == taken {
+		t.Error("plugin still on the port taken")
+	}
+}
+
+func TestListenPlugin(t *testing.T) {
+	remote := echoServer(t)
+	p, l, err := listenPlugin(testPlugin, "", remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Addr().String() != p.addr() {
+		t.Errorf("listening on %v, plugin reaching %v", l.Addr(), p.addr())
+	}
+}
+
+func TestPluginCloseWithConns(t *testing.T) {
+	p, err := clientPlugin(testPlugin, "", echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.start()
+	eventually(t, 5*time.Second, func() error { return roundTrip(p.addr()) })
+
+	c, err := p.dial(context.Background(), (&transport{}).dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if err := roundTripConn(c); err != nil {
+		t.Fatalf("connection through a closed plugin: %v", err)
+	}
+
+	c.Close()
+	eventually(t, 5*time.Second, func() error {
+		if roundTrip(p.addr()) == nil {
+			return errors.New("plugin still serving after its connections are done")
+		}
+		return nil
+	})
+}
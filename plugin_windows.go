@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// terminate kills a plugin process, as Windows has no signal to ask it to exit.
+func terminate(p *os.Process) error { return p.Kill() }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// connPool keeps connected TCP connections to a server ready to be handed
+// out before the cipher is applied, so each still gets its own salt.
+type connPool struct {
+	addr    string // of the server, for logs
+	dial    func(ctx context.Context) (net.Conn, error)
+	size    int
+	maxIdle time.Duration // replaced once idle this long, before the server or middleboxes time out
+	wake    chan struct{}
+
+	mu   sync.Mutex
+	idle []pooledConn
+}
+
+type pooledConn struct {
+	net.Conn
+	since   time.Time
+	latency time.Duration // of dialing it
+}
+
+// newConnPool starts keeping size connections to the server at addr,
+// connected by dial, until ctx is done.
+func newConnPool(ctx context.Context, addr string, dial func(context.Context) (net.Conn, error), size int, maxIdle time.Duration) *connPool {
+	p := &connPool{addr: addr, dial: dial, size: size, maxIdle: maxIdle, wake: make(chan struct{}, 1)}
+	go p.run(ctx)
+	return p
+}
+
+// get returns a pooled connection and how long it took to dial, or nil if
+// none is alive.
+func (p *connPool) get() (net.Conn, time.Duration) {
+	defer p.refill()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.idle) > 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(pc.since) < p.maxIdle && alive(pc.Conn) {
+			return pc.Conn, pc.latency
+		}
+		pc.Close()
+	}
+	return nil, 0
+}
+
+func (p *connPool) refill() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *connPool) run(ctx context.Context) {
+	tick := time.NewTicker(p.maxIdle / 4)
+	defer tick.Stop()
+	for {
+		p.prune()
+		p.fill(ctx)
+		select {
+		case <-ctx.Done():
+			p.mu.Lock()
+			for _, pc := range p.idle {
+				pc.Close()
+			}
+			p.idle = nil
+			p.mu.Unlock()
+			return
+		case <-tick.C:
+		case <-p.wake:
+		}
+	}
+}
+
+// prune closes connections idle too long or closed by the server.
+func (p *connPool) prune() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	live := p.idle[:0]
+	for _, pc := range p.idle {
+		if time.Since(pc.since) < p.maxIdle && alive(pc.Conn) {
+			live = append(live, pc)
+		} else {
+			pc.Close()
+		}
+	}
+	p.idle = live
+}
+
+// fill dials until the pool is full, stopping at the first failure.
+func (p *connPool) fill(ctx context.Context) {
+	for {
+		p.mu.Lock()
+		n := len(p.idle)
+		p.mu.Unlock()
+		if n >= p.size {
+			return
+		}
+		dctx, cancel := context.WithTimeout(ctx, p.maxIdle)
+		t0 := time.Now()
+		c, err := p.dial(dctx)
+		cancel()
+		if err != nil {
+			logf("failed to fill connection pool of %s: %v", p.addr, err)
+			return
+		}
+		p.mu.Lock()
+		p.idle = append(p.idle, pooledConn{c, time.Now(), time.Since(t0)})
+		p.mu.Unlock()
+	}
+}
+
+// alive reports whether the server has neither closed c nor sent anything,
+// which it never does before the client speaks.
+func alive(c net.Conn) bool {
+	c.SetReadDeadline(time.Now())
+	var b [1]byte
+	_, err := c.Read(b[:])
+	c.SetReadDeadline(time.Time{})
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return true
+	}
+	return false
+}
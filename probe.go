@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/riobard/go-shadowsocks2/socks"
+	"github.com/riobard/go-shadowsocks2/speeddial"
+)
+
+const probeTimeout = 5 * time.Second
+
+// parseProbe returns a health check of servers against the probe target u,
+// either http://host[:port]/path expecting a 2xx response, or echo://host:port
+// expecting the bytes sent to come back.
+func parseProbe(u string) (speeddial.Probe, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	host := pu.Host
+	switch pu.Scheme {
+	case "http":
+		if pu.Port() == "" {
+			host = net.JoinHostPort(host, "80")
+		}
+	case "echo":
+		if pu.Port() == "" {
+			return nil, fmt.Errorf("missing port in probe %q", u)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported probe %q", u)
+	}
+	tgt := socks.ParseAddr(host)
+	if tgt == nil {
+		return nil, fmt.Errorf("invalid probe address %q", host)
+	}
+
+	return func(c net.Conn) error {
+		c.SetDeadline(time.Now().Add(probeTimeout))
+		if _, err := c.Write(tgt); err != nil {
+			return err
+		}
+		if pu.Scheme == "echo" {
+			b := make([]byte, 16)
+			rand.Read(b)
+			if _, err := c.Write(b); err != nil {
+				return err
+			}
+			r := make([]byte, len(b))
+			if _, err := io.ReadFull(c, r); err != nil {
+				return err
+			}
+			if !bytes.Equal(b, r) {
+				return fmt.Errorf("probe %s echoed wrong bytes", host)
+			}
+			return nil
+		}
+
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return err
+		}
+		req.Close = true
+		if err := req.Write(c); err != nil {
+			return err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(c), req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("probe %s returned %s", u, resp.Status)
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/riobard/go-shadowsocks2/resolver"
+)
+
+// resolver of target domains shared by tcpRemote and udpRemote
+var targetResolver = struct {
+	sync.Mutex
+	spec string
+	r    *resolver.Resolver
+}{}
+
+// prepareResolver returns a function changing the upstream DNS servers and
+// address preference used to resolve target domains. The cache is kept if
+// neither changes.
+func prepareResolver(upstreams []string, prefer string) (func(), error) {
+	var p resolver.Preference
+	switch prefer {
+	case "":
+	case "ipv4":
+		p = resolver.PreferIPv4
+	case "ipv6":
+		p = resolver.PreferIPv6
+	default:
+		return nil, fmt.Errorf("invalid address preference %q", prefer)
+	}
+	r, err := resolver.New(upstreams, p)
+	if err != nil {
+		return nil, err
+	}
+	spec := strings.Join(upstreams, " ") + "/" + prefer
+	return func() {
+		targetResolver.Lock()
+		defer targetResolver.Unlock()
+		if spec != targetResolver.spec || targetResolver.r == nil {
+			targetResolver.spec = spec
+			targetResolver.r = r
+		}
+	}, nil
+}
+
+// targetDNS returns the resolver of target domains.
+func targetDNS() *resolver.Resolver {
+	targetResolver.Lock()
+	defer targetResolver.Unlock()
+	if targetResolver.r == nil {
+		targetResolver.r, _ = resolver.New(nil, resolver.PreferNone)
+	}
+	return targetResolver.r
+}
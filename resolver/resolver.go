@@ -0,0 +1,279 @@
+// Package resolver implements a caching DNS stub resolver.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	negativeTTL = 5 * time.Second // for failed lookups
+	maxTTL      = time.Hour       // cap on TTL of cached answers
+	maxEntries  = 10000           // entries are swept beyond this
+	timeout     = 5 * time.Second // per upstream query
+
+	// how long DialTCP waits on an address before trying the next one as
+	// well, as in Happy Eyeballs
+	fallbackDelay = 300 * time.Millisecond
+)
+
+// ErrNotFound means that the domain has no A or AAAA records.
+var ErrNotFound = errors.New("no such host")
+
+// Preference orders addresses returned by a Resolver.
+type Preference int
+
+const (
+	PreferNone Preference = iota // in the order A records then AAAA records, IPv4 first for UDP
+	PreferIPv4
+	PreferIPv6
+)
+
+// Resolver looks up IP addresses of domains, caching answers of upstreams for
+// their TTL and deduplicating concurrent lookups of the same domain.
+type Resolver struct {
+	upstreams []upstream // system resolver if empty
+	prefer    Preference
+
+	mu    sync.Mutex
+	cache map[string]*entry
+}
+
+type entry struct {
+	done    chan struct{} // closed once the lookup completes
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// New creates a Resolver querying upstreams in order until one answers.
+// Each upstream is a URL like udp://1.1.1.1:53, tcp://1.1.1.1:53 or
+// tls://1.1.1.1:853 for DNS over TLS. A bare address means UDP. The system
+// resolver is used, uncached as it gives no TTL, if upstreams is empty.
+func New(upstreams []string, prefer Preference) (*Resolver, error) {
+	r := &Resolver{prefer: prefer, cache: make(map[string]*entry)}
+	for _, s := range upstreams {
+		if !strings.Contains(s, "://") {
+			s = "udp://" + s
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "udp", "tcp", "tls":
+		default:
+			return nil, fmt.Errorf("unsupported DNS upstream %q", s)
+		}
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("invalid DNS upstream %q: %v", s, err)
+		}
+		r.upstreams = append(r.upstreams, upstream{network: u.Scheme, addr: u.Host})
+	}
+	return r, nil
+}
+
+// LookupIP returns the IP addresses of host ordered by preference.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if len(r.upstreams) == 0 {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err == nil && len(ips) == 0 {
+			err = ErrNotFound
+		}
+		return r.sort(ips), err
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	r.mu.Lock()
+	e := r.cache[host]
+	if e != nil {
+		select {
+		case <-e.done:
+			if time.Now().After(e.expires) {
+				e = nil
+			}
+		default: // lookup in progress
+		}
+	}
+	if e == nil {
+		if len(r.cache) >= maxEntries {
+			r.sweep()
+		}
+		e = &entry{done: make(chan struct{})}
+		r.cache[host] = e
+		go r.lookup(host, e)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return e.ips, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sweep removes expired entries, then arbitrary others while still above 90%
+// of maxEntries. Caller must hold r.mu.
+func (r *Resolver) sweep() {
+	now := time.Now()
+	for _, all := range []bool{false, true} {
+		for k, e := range r.cache {
+			if all && len(r.cache) < maxEntries*9/10 {
+				return
+			}
+			select {
+			case <-e.done:
+				if all || now.After(e.expires) {
+					delete(r.cache, k)
+				}
+			default:
+			}
+		}
+	}
+}
+
+func (r *Resolver) lookup(host string, e *entry) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Duration(len(r.upstreams)))
+	defer cancel()
+
+	var ttl time.Duration
+	e.ips, ttl, e.err = r.query(ctx, host)
+	if e.err == nil && len(e.ips) == 0 {
+		e.err = ErrNotFound
+	}
+	if e.err != nil {
+		ttl = negativeTTL
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	e.ips = r.sort(e.ips)
+	e.expires = time.Now().Add(ttl)
+	close(e.done)
+}
+
+// query asks upstreams in order for A and AAAA records of host.
+func (r *Resolver) query(ctx context.Context, host string) (ips []net.IP, ttl time.Duration, err error) {
+	for _, u := range r.upstreams {
+		if ips, ttl, err = u.lookup(ctx, host); err == nil || errors.Is(err, ErrNotFound) {
+			return
+		}
+	}
+	return
+}
+
+// sort orders ips by preference, keeping the relative order otherwise.
+func (r *Resolver) sort(ips []net.IP) []net.IP {
+	if r.prefer == PreferNone {
+		return ips
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		i4, j4 := ips[i].To4() != nil, ips[j].To4() != nil
+		if r.prefer == PreferIPv4 {
+			return i4 && !j4
+		}
+		return !i4 && j4
+	})
+	return ips
+}
+
+// ResolveUDPAddr resolves a host:port address like net.ResolveUDPAddr,
+// returning the most preferred IP address, the first IPv4 one if none is.
+func (r *Resolver) ResolveUDPAddr(ctx context.Context, addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ip := ips[0]
+	if r.prefer == PreferNone {
+		for _, a := range ips {
+			if a.To4() != nil {
+				ip = a
+				break
+			}
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: p}, nil
+}
+
+// DialTCP connects to a host:port address, trying each IP address of host in
+// order of preference. Each address gets fallbackDelay before the next one
+// is tried in parallel, and the first to connect wins.
+func (r *Resolver) DialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	ch := make(chan result, len(ips))
+	var d net.Dialer
+	next, pending := 0, 0
+	start := func() {
+		a := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			c, err := d.DialContext(ctx, "tcp", a)
+			ch <- result{c, err}
+		}()
+	}
+
+	for start(); pending > 0; {
+		var fallback <-chan time.Time
+		if next < len(ips) {
+			t := time.NewTimer(fallbackDelay)
+			defer t.Stop()
+			fallback = t.C
+		}
+		select {
+		case res := <-ch:
+			pending--
+			if res.err == nil {
+				go func(n int) { // close late winners
+					for ; n > 0; n-- {
+						if res := <-ch; res.err == nil {
+							res.c.Close()
+						}
+					}
+				}(pending)
+				return res.c, nil
+			}
+			err = res.err
+			if next < len(ips) {
+				start()
+			}
+		case <-fallback:
+			start()
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,227 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var errMismatch = errors.New("mismatched DNS response")
+
+// upstream is a DNS server queried over UDP, TCP or TLS.
+type upstream struct {
+	network string // udp, tcp or tls
+	addr    string
+}
+
+// lookup queries A and AAAA records of host concurrently and returns the
+// addresses with the lowest TTL of all records.
+func (u upstream) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	ch := make(chan result, len(types))
+	for _, t := range types {
+		go func(t dnsmessage.Type) {
+			var r result
+			r.ips, r.ttl, r.err = u.query(ctx, name, t)
+			ch <- r
+		}(t)
+	}
+
+	var ips []net.IP
+	ttl := time.Duration(-1)
+	err = nil
+	for range types {
+		r := <-ch
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		ips = append(ips, r.ips...)
+		if len(r.ips) > 0 && (ttl < 0 || r.ttl < ttl) {
+			ttl = r.ttl
+		}
+	}
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	if err == nil {
+		err = ErrNotFound
+	}
+	return nil, 0, err
+}
+
+// query asks for records of type t of name.
+func (u upstream) query(ctx context.Context, name dnsmessage.Name, t dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, 0, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: t, Class: dnsmessage.ClassINET})
+	q, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	network := u.network
+	resp, err := Exchange(ctx, network, u.addr, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips, ttl, truncated, err := parse(resp, q)
+	if truncated && network == "udp" {
+		if resp, err = Exchange(ctx, "tcp", u.addr, q); err != nil {
+			return nil, 0, err
+		}
+		ips, ttl, _, err = parse(resp, q)
+	}
+	return ips, ttl, err
+}
+
+// parse extracts A and AAAA records answering query q from msg.
+func parse(msg, q []byte) (ips []net.IP, ttl time.Duration, truncated bool, err error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return
+	}
+	if h.ID != binary.BigEndian.Uint16(q) || !h.Response {
+		err = errMismatch
+		return
+	}
+	if h.RCode == dnsmessage.RCodeNameError {
+		err = ErrNotFound
+		return
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		err = errors.New("DNS error: " + h.RCode.String())
+		return
+	}
+	truncated = h.Truncated
+	if err = p.SkipAllQuestions(); err != nil {
+		return
+	}
+	minTTL := uint32(1<<32 - 1)
+	for {
+		ah, e := p.AnswerHeader()
+		if e == dnsmessage.ErrSectionDone {
+			break
+		}
+		if e != nil {
+			err = e
+			return
+		}
+		if ah.TTL < minTTL {
+			minTTL = ah.TTL
+		}
+		switch ah.Type {
+		case dnsmessage.TypeA:
+			r, e := p.AResource()
+			if e != nil {
+				err = e
+				return
+			}
+			ips = append(ips, net.IP(r.A[:]))
+		case dnsmessage.TypeAAAA:
+			r, e := p.AAAAResource()
+			if e != nil {
+				err = e
+				return
+			}
+			ips = append(ips, net.IP(r.AAAA[:]))
+		default:
+			if err = p.SkipAnswer(); err != nil {
+				return
+			}
+		}
+	}
+	ttl = time.Duration(minTTL) * time.Second
+	return
+}
+
+// Exchange sends DNS message q to the server at addr over network udp, tcp
+// or tls, and returns the response.
+func Exchange(ctx context.Context, network, addr string, q []byte) ([]byte, error) {
+	var d net.Dialer
+	var c net.Conn
+	var err error
+	switch network {
+	case "tls":
+		host, _, _ := net.SplitHostPort(addr)
+		td := tls.Dialer{NetDialer: &d, Config: &tls.Config{ServerName: host}}
+		c, err = td.DialContext(ctx, "tcp", addr)
+	default:
+		c, err = d.DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if t, ok := ctx.Deadline(); ok {
+		c.SetDeadline(t)
+	}
+
+	if network == "udp" {
+		if _, err := c.Write(q); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			if n >= 2 && buf[0] == q[0] && buf[1] == q[1] { // ignore responses to other queries
+				return buf[:n], nil
+			}
+		}
+	}
+
+	if err := WriteMsg(c, q); err != nil {
+		return nil, err
+	}
+	return ReadMsg(c)
+}
+
+// WriteMsg writes DNS message m to a stream, prefixed by its 2-byte length
+// as in TCP and TLS.
+func WriteMsg(w io.Writer, m []byte) error {
+	buf := make([]byte, 2+len(m))
+	binary.BigEndian.PutUint16(buf, uint16(len(m)))
+	copy(buf[2:], m)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadMsg reads a DNS message prefixed by its 2-byte length from a stream.
+func ReadMsg(r io.Reader) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	m := make([]byte, binary.BigEndian.Uint16(n[:]))
+	_, err := io.ReadFull(r, m)
+	return m, err
+}
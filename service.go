@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+type closer interface{ Close() error }
+
+// A service starts a listener and returns what to close to stop it.
+type service func() (closer, error)
+
+// A serviceKey identifies a service by a loggable name and its full
+// configuration including secrets. Any change in the configuration of a
+// listener changes its key, so that reloading restarts only that listener.
+type serviceKey struct{ name, spec string }
+
+type services map[serviceKey]service
+
+type runningService struct {
+	closer
+	start service // to restart it if its replacement fails
+}
+
+// pending holds changes of global state a config makes, such as the client
+// dialer, to commit once its services have started or to discard otherwise.
+type pending struct {
+	commits  []func()
+	discards []func()
+}
+
+// add registers commit to run if the config applies, and discard if not.
+// Either may be nil.
+func (p *pending) add(commit, discard func()) {
+	if commit != nil {
+		p.commits = append(p.commits, commit)
+	}
+	if discard != nil {
+		p.discards = append(p.discards, discard)
+	}
+}
+
+func (p *pending) commit() {
+	for _, f := range p.commits {
+		f()
+	}
+}
+
+func (p *pending) discard() {
+	for _, f := range p.discards {
+		f()
+	}
+}
+
+var running = struct {
+	sync.Mutex
+	m map[serviceKey]runningService
+}{m: make(map[serviceKey]runningService)}
+
+// apply starts services in cfg not yet running and stops those no longer in
+// cfg. Stopping a service closes its listener only, so established connections
+// keep going with the cipher they started with. New listeners start before
+// old ones stop, which are kept if any fails to start. A listener changed on
+// the same address must stop first, and is restored if its replacement fails.
+// Global settings change only once all services have started, or before they
+// start if none is running yet.
+func apply(ctx context.Context, cfg *Config) error {
+	var p pending
+	commitQueue, err := prepareUDPQueue(cfg)
+	if err != nil {
+		return err
+	}
+	p.add(commitQueue, nil)
+
+	svcs := make(services)
+	if len(cfg.Client) > 0 {
+		if err := client(ctx, cfg, svcs, &p); err != nil {
+			p.discard()
+			return err
+		}
+	}
+	if len(cfg.Server) > 0 {
+		if err := server(ctx, cfg, svcs, &p); err != nil {
+			p.discard()
+			return err
+		}
+	}
+
+	running.Lock()
+	defer running.Unlock()
+
+	initial := len(running.m) == 0
+	if initial { // nothing to keep on failure, and services need the settings
+		p.commit()
+	}
+
+	byName := make(map[string]serviceKey)
+	for k := range running.m {
+		byName[k.name] = k
+	}
+
+	restored := make(map[serviceKey]bool)
+	for k, start := range svcs {
+		if _, ok := running.m[k]; ok {
+			continue
+		}
+		old, replace := byName[k.name]
+		if replace {
+			logf("stopping %s", old.name)
+			running.m[old].Close()
+		}
+		c, e := start()
+		if e != nil {
+			if err == nil {
+				err = fmt.Errorf("failed to start %s: %v", k.name, e)
+			}
+			logf("failed to start %s: %v", k.name, e)
+			if replace {
+				if c, e := running.m[old].start(); e == nil {
+					running.m[old] = runningService{c, running.m[old].start}
+					restored[old] = true
+					logf("restored %s", old.name)
+				} else {
+					logf("failed to restore %s: %v", old.name, e)
+					delete(running.m, old)
+				}
+			}
+			continue
+		}
+		if replace {
+			delete(running.m, old)
+		}
+		running.m[k] = runningService{c, start}
+	}
+
+	if err != nil {
+		if !initial {
+			p.discard()
+		}
+		logf("keeping services no longer configured until a reload succeeds")
+		return err
+	}
+	if !initial {
+		p.commit()
+	}
+	for k, c := range running.m {
+		if _, ok := svcs[k]; !ok && !restored[k] {
+			logf("stopping %s", k.name)
+			c.Close()
+			delete(running.m, k)
+		}
+	}
+	return err
+}
+
+// stopAll stops every running service.
+func stopAll() {
+	running.Lock()
+	defer running.Unlock()
+
+	for k, c := range running.m {
+		logf("stopping %s", k.name)
+		c.Close()
+		delete(running.m, k)
+	}
+}
@@ -0,0 +1,71 @@
+package shadowaead
+
+import (
+	"golang.org/x/net/ipv4"
+)
+
+// BatchConn reads and writes several packets per call, like ipv4.PacketConn
+// and ipv6.PacketConn which use recvmmsg and sendmmsg on Linux. Each message
+// must have exactly one buffer.
+type BatchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// ReadBatch reads packets into ms using the embedded PacketConn and decrypts
+// each in place. Packets failing decryption are dropped and the remaining
+// ones moved to the front of ms. Returns the number of packets decrypted.
+// Reads a single packet like ReadFrom if the embedded PacketConn is not a
+// BatchConn.
+func (c *PacketConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	bc, ok := c.PacketConn.(BatchConn)
+	if !ok {
+		n, addr, err := c.ReadFrom(ms[0].Buffers[0])
+		if err != nil {
+			return 0, err
+		}
+		ms[0].N, ms[0].Addr = n, addr
+		return 1, nil
+	}
+	n, err := bc.ReadBatch(ms, flags)
+	k := 0
+	for i := 0; i < n; i++ {
+		b := ms[i].Buffers[0]
+		bb, err := Unpack(b[c.Cipher.SaltSize():], b[:ms[i].N], c)
+		if err != nil {
+			continue
+		}
+		copy(b, bb)
+		ms[i].N = len(bb)
+		ms[k], ms[i] = ms[i], ms[k]
+		k++
+	}
+	return k, err
+}
+
+// WriteBatch encrypts packets in ms and writes them using the embedded
+// PacketConn, one at a time if it is not a BatchConn. Returns the number of
+// packets written.
+func (c *PacketConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	bc, ok := c.PacketConn.(BatchConn)
+	if !ok {
+		for i := range ms {
+			if _, err := c.WriteTo(ms[i].Buffers[0], ms[i].Addr); err != nil {
+				return i, err
+			}
+		}
+		return len(ms), nil
+	}
+	out := make([]ipv4.Message, len(ms))
+	for i := range ms {
+		buf := bufferPool.Get().([]byte)
+		defer bufferPool.Put(buf)
+		buf, err := Pack(buf, ms[i].Buffers[0], c)
+		if err != nil {
+			return 0, err
+		}
+		out[i].Buffers = [][]byte{buf}
+		out[i].Addr = ms[i].Addr
+	}
+	return bc.WriteBatch(out, flags)
+}
@@ -0,0 +1,87 @@
+package shadowaead
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+const benchBatch = 16
+
+// batchUDPConn adds batch I/O to a UDP socket, as batchable does in main.
+type batchUDPConn struct {
+	*net.UDPConn
+	BatchConn
+}
+
+func benchConn(b *testing.B, batch bool, ciph Cipher) *PacketConn {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	c.SetReadBuffer(4 << 20)
+	c.SetWriteBuffer(4 << 20)
+	if batch {
+		return NewPacketConn(&batchUDPConn{c, ipv4.NewPacketConn(c)}, ciph)
+	}
+	return NewPacketConn(c, ciph)
+}
+
+// benchmarkUDPRelay sends b.N encrypted packets in batches over loopback and
+// reports the packets per second received and decrypted. Packets lost by the
+// kernel are not counted.
+func benchmarkUDPRelay(b *testing.B, batch bool) {
+	ciph, err := Chacha20Poly1305(make([]byte, 32))
+	if err != nil {
+		b.Fatal(err)
+	}
+	src, dst := benchConn(b, batch, ciph), benchConn(b, batch, ciph)
+	defer src.Close()
+	defer dst.Close()
+
+	out := make([]ipv4.Message, benchBatch)
+	for i := range out {
+		out[i].Buffers = [][]byte{make([]byte, 1200)}
+		out[i].Addr = dst.LocalAddr()
+	}
+	in := make([]ipv4.Message, benchBatch)
+	for i := range in {
+		in[i].Buffers = [][]byte{make([]byte, 2048)}
+	}
+
+	got := make(chan int)
+	go func() {
+		n := 0
+		for n < b.N {
+			dst.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			k, err := dst.ReadBatch(in, 0)
+			n += k
+			if err != nil {
+				break
+			}
+		}
+		got <- n
+	}()
+
+	b.SetBytes(1200)
+	b.ResetTimer()
+	t0 := time.Now()
+	for sent := 0; sent < b.N; {
+		k := benchBatch
+		if b.N-sent < k {
+			k = b.N - sent
+		}
+		if _, err := src.WriteBatch(out[:k], 0); err != nil {
+			b.Fatal(err)
+		}
+		sent += k
+	}
+	n := <-got
+	b.StopTimer()
+	b.ReportMetric(float64(n)/time.Since(t0).Seconds(), "pkts/s")
+}
+
+func BenchmarkUDPRelayBatch(b *testing.B)  { benchmarkUDPRelay(b, true) }
+func BenchmarkUDPRelaySingle(b *testing.B) { benchmarkUDPRelay(b, false) }
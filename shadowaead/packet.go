@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 )
 
 // ErrShortPacket means that the packet is too short for a valid encrypted packet.
@@ -52,6 +53,9 @@ func Unpack(dst, pkt []byte, ciph Cipher) ([]byte, error) {
 		return nil, io.ErrShortBuffer
 	}
 	b, err := aead.Open(dst[:0], _zerononce[:aead.NonceSize()], pkt[saltSize:], nil)
+	if err != nil {
+		atomic.AddInt64(&authFailures.packet, 1)
+	}
 	return b, err
 }
 
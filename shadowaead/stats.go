@@ -0,0 +1,12 @@
+package shadowaead
+
+import "sync/atomic"
+
+// number of stream records and packets failing authentication
+var authFailures struct{ stream, packet int64 }
+
+// AuthFailures returns the number of stream records and packets that failed
+// authentication, most likely because of a wrong password or tampering.
+func AuthFailures() (stream, packet int64) {
+	return atomic.LoadInt64(&authFailures.stream), atomic.LoadInt64(&authFailures.packet)
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -102,6 +103,7 @@ func (r *Reader) read(p []byte) (int, error) {
 	_, err := r.Open(p[:0], nonce, p, nil)
 	increment(nonce)
 	if err != nil {
+		atomic.AddInt64(&authFailures.stream, 1)
 		return 0, err
 	}
 
@@ -114,6 +116,7 @@ func (r *Reader) read(p []byte) (int, error) {
 	_, err = r.Open(p[:0], nonce, p, nil)
 	increment(nonce)
 	if err != nil {
+		atomic.AddInt64(&authFailures.stream, 1)
 		return 0, err
 	}
 	return size, nil
@@ -0,0 +1,119 @@
+package speeddial
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// ErrOpen means that a target was not dialed because its breaker is open.
+var ErrOpen = errors.New("circuit breaker open")
+
+// BreakerState is the state of the circuit breaker of a target.
+type BreakerState int
+
+const (
+	Closed   BreakerState = iota // dialed as usual
+	Open                         // not dialed until the backoff passes
+	HalfOpen                     // a single dial probes whether it recovered
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// WithBreaker opens the circuit breaker of a target after failures
+// consecutive failed dials. An open target is left alone for an exponential
+// backoff from min up to max with jitter, then a single dial probes it: the
+// breaker closes on success and opens again for longer on failure. Disabled
+// if failures is not positive, the default.
+func WithBreaker(failures int, min, max time.Duration) Option {
+	return func(d *Dialer) {
+		for i := range d.targets {
+			d.targets[i].breaker = breaker{threshold: failures, min: min, max: max}
+		}
+	}
+}
+
+type breaker struct {
+	threshold int
+	min, max  time.Duration
+
+	fails   int       // consecutive failures
+	total   int64     // all failures
+	trips   uint      // consecutive times opened without recovering
+	retryAt time.Time // when an open breaker lets a probe through
+	probing bool      // half-open probe in flight
+}
+
+// state returns the state of b at now. Caller must hold the lock of the target.
+func (b *breaker) state(now time.Time) BreakerState {
+	switch {
+	case b.trips == 0:
+		return Closed
+	case now.Before(b.retryAt) || b.probing:
+		return Open
+	}
+	return HalfOpen
+}
+
+// allow reports whether t may be dialed now.
+func (t *target) allow() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.breaker.state(time.Now()) != Open
+}
+
+// acquire claims a dial of t, which is the probe if half-open.
+func (t *target) acquire() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch t.breaker.state(time.Now()) {
+	case Open:
+		return false
+	case HalfOpen:
+		t.breaker.probing = true
+	}
+	return true
+}
+
+// cancel gives up a dial of t claimed by acquire without judging t.
+func (t *target) cancel() {
+	t.mu.Lock()
+	t.breaker.probing = false
+	t.mu.Unlock()
+}
+
+// record updates the breaker of t with the result of a dial.
+func (t *target) record(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.breaker
+	probe := b.probing
+	b.probing = false
+	if err == nil {
+		b.fails, b.trips = 0, 0
+		return
+	}
+	b.fails++
+	b.total++
+	if b.threshold <= 0 || (!probe && (b.trips > 0 || b.fails < b.threshold)) {
+		return // opened already unless the probe failed
+	}
+	backoff := b.max
+	if b.trips < 32 && b.min<<b.trips < b.max {
+		backoff = b.min << b.trips
+	}
+	b.trips++
+	if backoff > 0 {
+		backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)) // jitter
+	}
+	b.retryAt = time.Now().Add(backoff)
+	logf("Breaker open for %v", backoff)
+}
@@ -1,8 +1,13 @@
 package speeddial
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -20,58 +25,152 @@ func logf(format string, v ...interface{}) {
 	}
 }
 
+// Dial connects to a target.
 type Dial func() (net.Conn, error)
 
+// Pooled may be implemented by connections a Dial hands out ready-made, e.g.
+// from a pool, to report how long they took to dial in the first place.
+type Pooled interface {
+	DialLatency() time.Duration
+}
+
+// ContextDial connects to a target, giving up once ctx is done.
+type ContextDial func(ctx context.Context) (net.Conn, error)
+
+type warmUpKey struct{}
+
+// WarmUp reports whether ctx is of a dial made only to measure the latency
+// of a target, which should connect afresh rather than take a connection
+// ready for use, e.g. from a pool.
+func WarmUp(ctx context.Context) bool {
+	v, _ := ctx.Value(warmUpKey{}).(bool)
+	return v
+}
+
 type target struct {
 	last     int64 // last dial since epoch
 	latency  int64 // exponetially smoothed
 	inflight int32 // number of inflight dial
-	dial     Dial
+	failed   int32 // 1 if the last health check failed
+	rtt      int64 // round trip of the last health check
+	active   int32 // number of connections not closed yet
+	weight   int   // for WeightedRandom
+	dial     ContextDial
+
+	mu      sync.Mutex
+	breaker breaker
 }
 
-func (t *target) Dial() (net.Conn, error) {
+func (t *target) Dial(ctx context.Context) (net.Conn, error) {
+	if !t.acquire() {
+		return nil, ErrOpen
+	}
 	atomic.AddInt32(&t.inflight, 1)
 	defer atomic.AddInt32(&t.inflight, -1)
 	t0 := time.Now()
 	if old, new := atomic.LoadInt64(&t.last), t0.Sub(epoch).Nanoseconds(); old < new {
 		atomic.CompareAndSwapInt64(&t.last, old, new)
 	}
-	c, err := t.dial()
+	c, err := t.dial(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) { // not the fault of t
+		t.cancel()
+		return nil, err
+	}
+	t.record(err)
 	latency := time.Since(t0).Nanoseconds()
 	if err != nil {
 		latency = int64(penalty)
+	} else if p, ok := c.(Pooled); ok {
+		latency = p.DialLatency().Nanoseconds()
 	}
 	old := atomic.LoadInt64(&t.latency)
 	if old > 0 {
 		latency = (weight*old + latency) / (weight + 1) // exponentially weighted moving average
 	}
 	atomic.CompareAndSwapInt64(&t.latency, old, latency)
-	return c, err
+	if err != nil {
+		return c, err
+	}
+	atomic.AddInt32(&t.active, 1)
+	return &conn{Conn: c, t: t}, nil
+}
+
+// conn counts active connections of its target.
+type conn struct {
+	net.Conn
+	t    *target
+	once sync.Once
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() { atomic.AddInt32(&c.t.active, -1) })
+	return c.Conn.Close()
 }
 
 type Dialer struct {
 	targets  []target
+	strategy Strategy
+	next     uint32        // for RoundRobin
+	attempts int           // targets to try per dial
+	deadline time.Duration // of all attempts of a dial, none if zero
+	race     int           // dials in flight at once
+	stagger  time.Duration // between starting racing dials
 	Cooldown time.Duration // default 10 seconds
+
+	ctx    context.Context // of background dials
+	cancel context.CancelFunc
 }
 
+// New creates a Dialer of the lowest latency target among ds.
 func New(ds ...Dial) *Dialer {
+	cds := make([]ContextDial, len(ds))
+	for i := range ds {
+		dial := ds[i]
+		cds[i] = func(context.Context) (net.Conn, error) { return dial() }
+	}
+	return NewContext(cds)
+}
+
+// NewContext creates a Dialer of targets dialed by ds, configured by opts.
+func NewContext(ds []ContextDial, opts ...Option) *Dialer {
 	tgts := make([]target, len(ds))
 	for i := range ds {
 		tgts[i].dial = ds[i]
+		tgts[i].weight = 1
+	}
+	d := &Dialer{targets: tgts, attempts: 1, race: 1, Cooldown: 10 * time.Second}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, o := range opts {
+		o(d)
 	}
-	return &Dialer{targets: tgts, Cooldown: 10 * time.Second}
+	return d
 }
 
-func (d *Dialer) Dial() (net.Conn, error) {
-	min := int64(1<<63 - 1)
-	var best int
-	for i := range d.targets {
-		if l := atomic.LoadInt64(&d.targets[i].latency); 0 < l && l < min {
-			best, min = i, l
-		}
-	}
+// Close cancels background dials and health checks. Connections already
+// dialed are not affected.
+func (d *Dialer) Close() error {
+	d.cancel()
+	return nil
+}
+
+// Dial connects to a target selected by the strategy.
+func (d *Dialer) Dial() (net.Conn, error) { return d.DialContext(context.Background(), "") }
 
-	logf("Best #%d [%dms]", best, min/1e6)
+// DialKey connects to a target selected by the strategy, keeping the same
+// target for the same key under ConsistentHash.
+func (d *Dialer) DialKey(key string) (net.Conn, error) {
+	return d.DialContext(context.Background(), key)
+}
+
+// DialContext is like DialKey but gives up once ctx is done.
+func (d *Dialer) DialContext(ctx context.Context, key string) (net.Conn, error) {
+	tried := make([]bool, len(d.targets))
+	best := d.pick(key, tried)
+	logf("Best #%d [%dms]", best, atomic.LoadInt64(&d.targets[best].latency)/1e6)
+
+	if d.race > 1 { // racing dials measure latency instead of warm-up dials
+		return d.dialRace(ctx, key, best, tried)
+	}
 
 	for i := range d.targets {
 		if i == best {
@@ -86,8 +185,11 @@ func (d *Dialer) Dial() (net.Conn, error) {
 			logf("Inflight #%d [%d]", i, n)
 			continue
 		}
+		if !tgt.allow() {
+			continue
+		}
 		go func(i int) {
-			c, err := tgt.Dial()
+			c, err := tgt.Dial(context.WithValue(d.ctx, warmUpKey{}, true))
 			if err == nil {
 				c.Close()
 			}
@@ -95,5 +197,205 @@ func (d *Dialer) Dial() (net.Conn, error) {
 		}(i)
 	}
 
-	return d.targets[best].Dial()
+	if d.attempts == 1 && d.deadline <= 0 {
+		return d.targets[best].Dial(ctx)
+	}
+	return d.dialRace(ctx, key, best, tried)
+}
+
+// ErrDeadline means that a dial gave up on a target at its deadline.
+var ErrDeadline = errors.New("dial deadline exceeded")
+
+// dialRace dials targets in the order picked, starting with first, until one
+// succeeds. Up to d.race dials are in flight at once, the next starting
+// d.stagger after the previous or as soon as one fails. At most d.attempts
+// targets, or d.race if more, are tried before the deadline or until ctx is
+// done. Dials losing the race are closed once done, still feeding their
+// latency back.
+func (d *Dialer) dialRace(ctx context.Context, key string, first int, tried []bool) (net.Conn, error) {
+	var cancel context.CancelFunc
+	if d.deadline > 0 {
+		ctx, cancel = context.WithTimeout(ctx, d.deadline)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	type result struct {
+		i   int
+		c   net.Conn
+		err error
+	}
+	ch := make(chan result, len(d.targets))
+	pending := make(map[int]bool)
+	next, started := first, 0
+	attempts := d.attempts
+	if attempts < d.race {
+		attempts = d.race
+	}
+	var last time.Time
+	start := func() {
+		tried[next] = true
+		pending[next] = true
+		go func(i int) {
+			c, err := d.targets[i].Dial(ctx)
+			ch <- result{i, c, err}
+		}(next)
+		last = time.Now()
+		if started++; started < attempts {
+			next = d.pick(key, tried)
+		} else {
+			next = -1
+		}
+	}
+	abandon := func() {
+		go func(n int) {
+			for ; n > 0; n-- {
+				if r := <-ch; r.err == nil {
+					r.c.Close()
+				}
+			}
+			cancel()
+		}(len(pending))
+	}
+
+	err := &DialError{}
+	for start(); len(pending) > 0; {
+		var stagger <-chan time.Time
+		if next >= 0 && len(pending) < d.race {
+			stagger = time.After(time.Until(last.Add(d.stagger)))
+		}
+		select {
+		case r := <-ch:
+			delete(pending, r.i)
+			if r.err == nil {
+				abandon()
+				return r.c, nil
+			}
+			logf("Failover #%d: %v", r.i, r.err)
+			err.Failures = append(err.Failures, Failure{r.i, r.err})
+			if next >= 0 && len(pending) < d.race {
+				start()
+			}
+		case <-stagger:
+			logf("Race #%d", next)
+			start()
+		case <-ctx.Done():
+			e := ctx.Err()
+			if e == context.DeadlineExceeded {
+				e = ErrDeadline
+			}
+			for i := range pending {
+				err.Failures = append(err.Failures, Failure{i, e})
+			}
+			abandon()
+			return nil, err
+		}
+	}
+	cancel()
+	return nil, err
+}
+
+// Failure is the error of dialing a target.
+type Failure struct {
+	Target int // index in the order given to New
+	Err    error
+}
+
+// DialError lists the failure of each target a dial tried in turn.
+type DialError struct {
+	Failures []Failure
+}
+
+func (e *DialError) Error() string {
+	s := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		s[i] = fmt.Sprintf("#%d: %v", f.Target, f.Err)
+	}
+	return "dial failed: " + strings.Join(s, "; ")
+}
+
+// Probe checks a connection freshly dialed to a target end to end, e.g. by
+// requesting a known destination through it.
+type Probe func(net.Conn) error
+
+// Check probes every target each interval until ctx is done. Dial avoids
+// targets whose last check failed as long as any other target passed.
+// Checks stop once ctx is done or d is closed.
+func (d *Dialer) Check(ctx context.Context, interval time.Duration, probe Probe) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		for i := range d.targets {
+			go func(t *target) {
+				ctx, cancel := context.WithTimeout(d.ctx, interval)
+				defer cancel()
+				t.check(ctx, probe)
+			}(&d.targets[i])
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (t *target) check(ctx context.Context, probe Probe) {
+	t0 := time.Now()
+	c, err := t.dial(ctx)
+	if errors.Is(ctx.Err(), context.Canceled) {
+		if err == nil {
+			c.Close()
+		}
+		return
+	}
+	if err == nil {
+		err = probe(c)
+		c.Close()
+	}
+	if err != nil {
+		logf("Check failed: %v", err)
+		atomic.StoreInt32(&t.failed, 1)
+		return
+	}
+	atomic.StoreInt64(&t.rtt, int64(time.Since(t0)))
+	atomic.StoreInt32(&t.failed, 0)
+	t.mu.Lock()
+	if !t.breaker.probing { // a passed check proves recovery as well
+		t.breaker.fails, t.breaker.trips = 0, 0
+	}
+	t.mu.Unlock()
+}
+
+// Stat is a snapshot of the state of a target.
+type Stat struct {
+	Latency  time.Duration // exponentially smoothed
+	Inflight int           // number of inflight dials
+	Active   int           // number of connections not closed yet
+	Healthy  bool          // false if the last health check failed
+	RTT      time.Duration // round trip of the last passed health check
+	Breaker  BreakerState
+	Failures int64 // failed dials
+	Streak   int   // consecutive failed dials
+}
+
+// Stats returns a snapshot of all targets in the order given to New.
+func (d *Dialer) Stats() []Stat {
+	s := make([]Stat, len(d.targets))
+	for i := range d.targets {
+		s[i].Latency = time.Duration(atomic.LoadInt64(&d.targets[i].latency))
+		s[i].Inflight = int(atomic.LoadInt32(&d.targets[i].inflight))
+		s[i].Active = int(atomic.LoadInt32(&d.targets[i].active))
+		s[i].Healthy = atomic.LoadInt32(&d.targets[i].failed) == 0
+		s[i].RTT = time.Duration(atomic.LoadInt64(&d.targets[i].rtt))
+		t := &d.targets[i]
+		t.mu.Lock()
+		s[i].Breaker = t.breaker.state(time.Now())
+		s[i].Failures = t.breaker.total
+		s[i].Streak = t.breaker.fails
+		t.mu.Unlock()
+	}
+	return s
 }
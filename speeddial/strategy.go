@@ -0,0 +1,160 @@
+package speeddial
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy selects the target of each dial among those passing health checks.
+type Strategy int
+
+const (
+	LowestLatency  Strategy = iota // lowest smoothed dial latency
+	RoundRobin                     // each target in turn
+	WeightedRandom                 // random target in proportion to its weight
+	LeastConns                     // fewest active connections
+	ConsistentHash                 // same target for the same key, e.g. destination host
+)
+
+var strategies = map[string]Strategy{
+	"latency":    LowestLatency,
+	"roundrobin": RoundRobin,
+	"random":     WeightedRandom,
+	"leastconn":  LeastConns,
+	"hash":       ConsistentHash,
+}
+
+// ParseStrategy returns the strategy named latency, roundrobin, random,
+// leastconn or hash.
+func ParseStrategy(s string) (Strategy, error) {
+	if st, ok := strategies[s]; ok {
+		return st, nil
+	}
+	return 0, fmt.Errorf("unknown strategy %q", s)
+}
+
+// An Option configures a Dialer.
+type Option func(*Dialer)
+
+// WithStrategy sets the strategy to select targets. Default LowestLatency.
+func WithStrategy(s Strategy) Option { return func(d *Dialer) { d.strategy = s } }
+
+// WithWeights sets the weights of targets for WeightedRandom in the order
+// given to New. Default 1 each.
+func WithWeights(w ...int) Option {
+	return func(d *Dialer) {
+		for i := range d.targets {
+			if i < len(w) && w[i] > 0 {
+				d.targets[i].weight = w[i]
+			}
+		}
+	}
+}
+
+// WithRetry makes a dial try up to attempts targets in turn until one
+// succeeds, giving up once deadline passes if positive. Default 1 attempt.
+func WithRetry(attempts int, deadline time.Duration) Option {
+	return func(d *Dialer) {
+		if attempts > 0 {
+			d.attempts = attempts
+		}
+		d.deadline = deadline
+	}
+}
+
+// WithRace makes a dial race up to n targets in the order picked, in the
+// style of Happy Eyeballs (RFC 8305): the next target is dialed stagger after
+// the previous one or as soon as it fails, and the first connection wins.
+// At least n targets are tried, more if WithRetry allows.
+func WithRace(n int, stagger time.Duration) Option {
+	return func(d *Dialer) {
+		if n > 0 {
+			d.race = n
+		}
+		d.stagger = stagger
+	}
+}
+
+// eligible returns the indexes of targets not tried yet, preferring those
+// whose breaker lets them be dialed and then those whose last health check
+// passed.
+func (d *Dialer) eligible(tried []bool) []int {
+	var all, allowed, healthy []int
+	for i := range d.targets {
+		if tried[i] {
+			continue
+		}
+		all = append(all, i)
+		if !d.targets[i].allow() {
+			continue
+		}
+		allowed = append(allowed, i)
+		if atomic.LoadInt32(&d.targets[i].failed) == 0 {
+			healthy = append(healthy, i)
+		}
+	}
+	switch {
+	case len(healthy) > 0:
+		return healthy
+	case len(allowed) > 0:
+		return allowed
+	}
+	return all
+}
+
+// pick returns the index of the target to dial for key among those not
+// tried yet, or -1 if all were.
+func (d *Dialer) pick(key string, tried []bool) int {
+	idx := d.eligible(tried)
+	if len(idx) == 0 {
+		return -1
+	}
+	switch d.strategy {
+	case RoundRobin:
+		n := atomic.AddUint32(&d.next, 1)
+		return idx[int(n-1)%len(idx)]
+	case WeightedRandom:
+		sum := 0
+		for _, i := range idx {
+			sum += d.targets[i].weight
+		}
+		r := rand.Intn(sum)
+		for _, i := range idx {
+			if r -= d.targets[i].weight; r < 0 {
+				return i
+			}
+		}
+	case LeastConns:
+		best, min := -1, int32(0)
+		for _, i := range idx {
+			if n := atomic.LoadInt32(&d.targets[i].active); best < 0 || n < min {
+				best, min = i, n
+			}
+		}
+		return best
+	case ConsistentHash:
+		if key != "" { // rendezvous hashing moves only keys of targets going away
+			best, max := -1, uint64(0)
+			for _, i := range idx {
+				h := fnv.New64a()
+				fmt.Fprintf(h, "%d/%s", i, key)
+				if s := h.Sum64(); best < 0 || s > max {
+					best, max = i, s
+				}
+			}
+			return best
+		}
+	}
+
+	var min int64
+	best := -1
+	for _, i := range idx {
+		if l := atomic.LoadInt64(&d.targets[i].latency); best < 0 || (0 < l && (min == 0 || l < min)) {
+			best, min = i, l
+		}
+	}
+	return best
+}
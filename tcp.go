@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io"
+	"log"
 	"net"
 	"os"
 	"sync"
@@ -11,72 +14,126 @@ import (
 	"github.com/riobard/go-shadowsocks2/socks"
 )
 
-func tcpLocal(l net.Listener, d Dialer) {
+// Accept connections on l and relay them via d. In-flight relays are closed
+// once ctx is done.
+func tcpLocal(ctx context.Context, l net.Listener, d Dialer) {
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			logf("failed to accept: %v", err)
 			continue
 		}
 		go func() {
 			defer c.Close()
+			defer track(ctx, c, &inflight.relays)()
 			laddr := c.LocalAddr()
 			if laddr == nil {
 				logf("failed to determine target address")
 				return
 			}
-			rc, err := d.Dial(laddr.Network(), laddr.String())
+			rc, err := d.DialContext(ctx, laddr.Network(), laddr.String())
 			if err != nil {
 				logf("failed to connect: %v", err)
 				return
 			}
 			defer rc.Close()
 			logf("proxy %s <--[%s]--> %s", c.RemoteAddr(), rc.RemoteAddr(), laddr)
-			if err = relay(rc, c); err != nil {
+			if err = relay(rc, countBytes(c, "client")); err != nil {
 				logf("relay error: %v", err)
 			}
 		}()
 	}
 }
 
-// Listen on addr for incoming connections.
-func tcpRemote(addr string, shadow func(net.Conn) net.Conn) {
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		logf("failed to listen on %s: %v", addr, err)
-		return
-	}
+// remote holds the settings of a server URL shared by tcpRemote and udpRemote.
+type remote struct {
+	user        *user
+	lim         *limiter
+	nat         natMode
+	udp         bool // UDP relaying allowed, natively or over TCP
+	dialTimeout time.Duration
+	forward     string // address to relay to instead of targets
+}
 
-	logf("listening TCP on %s", addr)
+// Accept incoming connections on l until it is closed and relay them for r.
+// In-flight relays are closed once ctx is done.
+func tcpRemote(ctx context.Context, l net.Listener, shadow func(net.Conn) net.Conn, r *remote) {
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			logf("failed to accept: %v", err)
 			continue
 		}
 
 		go func() {
 			defer c.Close()
-			c = shadow(c)
-
-			tgt, err := socks.ReadAddr(c)
-			if err != nil {
-				logf("failed to get target address from %v: %v", c.RemoteAddr(), err)
+			defer track(ctx, c, nil)() // counted once relayed to a target
+			if err := r.user.check(); err != nil {
+				log.Printf("reject %v: %v", c.RemoteAddr(), err)
 				return
 			}
+			r.serve(ctx, shadow(c), true)
+		}()
+	}
+}
 
-			rc, err := net.Dial("tcp", tgt.String())
-			if err != nil {
-				logf("failed to connect to target: %v", err)
-				return
-			}
-			defer rc.Close()
+// serve relays c, a decrypted client stream, to the target it starts with.
+// Streams multiplexed over c are served as well if muxable.
+func (r *remote) serve(ctx context.Context, c net.Conn, muxable bool) {
+	tgt, err := socks.ReadAddr(c)
+	if err != nil {
+		logf("failed to get target address from %v: %v", c.RemoteAddr(), err)
+		return
+	}
 
-			logf("proxy %s <-> %s", c.RemoteAddr(), tgt)
-			if err = relay(c, rc); err != nil {
-				logf("relay error: %v", err)
-			}
-		}()
+	if muxable && bytes.Equal(tgt, muxTarget) {
+		muxRemote(ctx, c, r)
+		return
+	}
+	if bytes.Equal(tgt, uotTarget) {
+		if !r.udp {
+			logf("reject UDP over TCP from %v: UDP not enabled", c.RemoteAddr())
+			return
+		}
+		uotRemote(ctx, c, r)
+		return
+	}
+
+	defer track(ctx, c, &inflight.relays)()
+	t0 := time.Now()
+	dctx, cancel := ctx, context.CancelFunc(func() {})
+	if r.dialTimeout > 0 {
+		dctx, cancel = context.WithTimeout(ctx, r.dialTimeout)
+	}
+	dst := tgt.String()
+	if r.forward != "" {
+		dst = r.forward
+	}
+	rc, err := targetDNS().DialTCP(dctx, dst)
+	cancel()
+	label := r.forward
+	if label == "" {
+		label, _, _ = net.SplitHostPort(dst)
+	}
+	observeDial(targetLabel(label), t0, err)
+	if err != nil {
+		logf("failed to connect to target: %v", err)
+		return
+	}
+	defer rc.Close()
+
+	logf("proxy %s <-> %s", c.RemoteAddr(), dst)
+	ipLim, release := ipLimit(c.RemoteAddr())
+	defer release()
+	rc = limitTarget(r.user.countConn(rc), r.lim, r.user.limiter(), ipLim)
+	if err = relay(c, countBytes(rc, "server")); err != nil {
+		logf("relay error: %v", err)
 	}
 }
 
@@ -0,0 +1,63 @@
+// Command fwdplugin is a SIP003 plugin for tests that forwards connections
+// from SS_LOCAL to SS_REMOTE as they are. Options are pid=path to write its
+// process ID to and term=path to create once terminated by a signal.
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	opts := make(map[string]string)
+	for _, kv := range strings.Split(os.Getenv("SS_PLUGIN_OPTIONS"), ";") {
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			opts[kv[:i]] = kv[i+1:]
+		}
+	}
+	local := net.JoinHostPort(os.Getenv("SS_LOCAL_HOST"), os.Getenv("SS_LOCAL_PORT"))
+	remote := net.JoinHostPort(os.Getenv("SS_REMOTE_HOST"), os.Getenv("SS_REMOTE_PORT"))
+
+	l, err := net.Listen("tcp", local)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if f := opts["pid"]; f != "" {
+		if err := os.WriteFile(f, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-sig
+		if f := opts["term"]; f != "" {
+			os.WriteFile(f, nil, 0644)
+		}
+		os.Exit(0)
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			defer c.Close()
+			rc, err := net.Dial("tcp", remote)
+			if err != nil {
+				return
+			}
+			defer rc.Close()
+			go io.Copy(rc, c)
+			io.Copy(c, rc)
+		}()
+	}
+}
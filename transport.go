@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// of WebSocket servers, against clients holding connections without
+// upgrading them
+const (
+	wsHeaderTimeout = 10 * time.Second // to send the request headers, including the TLS handshake
+	wsIdleTimeout   = time.Minute      // between requests not upgraded
+)
+
+// transport carries the stream of a server URL, over plain TCP by default or
+// inside WebSocket binary frames with transport=ws or wss, so that servers
+// can sit behind HTTP proxies and CDNs. Query path sets the request path,
+// host the Host header and TLS server name, and for wss servers cert and key
+// the certificate files.
+type transport struct {
+	ws        bool
+	tls       bool
+	path      string
+	host      string
+	cert, key string
+}
+
+func parseTransport(s string) (*transport, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	t := &transport{path: q.Get("path"), host: q.Get("host"), cert: q.Get("cert"), key: q.Get("key")}
+	switch v := q.Get("transport"); v {
+	case "", "tcp":
+	case "ws":
+		t.ws = true
+	case "wss":
+		t.ws, t.tls = true, true
+	default:
+		return nil, fmt.Errorf("unknown transport %q", v)
+	}
+	if t.path == "" {
+		t.path = "/"
+	}
+	return t, nil
+}
+
+// dial connects to the server at addr.
+func (t *transport) dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil || !t.ws {
+		return raw, err
+	}
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			raw.SetDeadline(time.Now()) // abort the handshake
+		case <-done:
+		}
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		raw.SetDeadline(deadline)
+	}
+
+	host := t.host
+	if host == "" {
+		host = addr
+	}
+	c, scheme := raw, "ws"
+	if t.tls {
+		name := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			name = h
+		}
+		c, scheme = tls.Client(raw, &tls.Config{ServerName: name}), "wss"
+	}
+	cfg := &websocket.Config{
+		Location: &url.URL{Scheme: scheme, Host: host, Path: t.path},
+		Origin:   &url.URL{Scheme: "http", Host: host},
+		Version:  websocket.ProtocolVersionHybi13,
+		Header:   make(http.Header),
+	}
+	ws, err := websocket.NewClient(cfg, c)
+	close(done)
+	<-stopped // not to abort once the deadline is cleared
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	raw.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return &wsConn{Conn: ws, laddr: raw.LocalAddr(), raddr: raw.RemoteAddr()}, nil
+}
+
+// listen wraps l to accept connections carried by t.
+func (t *transport) listen(l net.Listener) (net.Listener, error) {
+	if !t.ws {
+		return l, nil
+	}
+	if t.tls {
+		cert, err := tls.LoadX509KeyPair(t.cert, t.key)
+		if err != nil {
+			return nil, err
+		}
+		l = tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	wl := &wsListener{Listener: l, conns: make(chan net.Conn), done: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.Handle(t.path, websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil }, // any origin
+		Handler:   wl.handle,
+	})
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: wsHeaderTimeout,
+		IdleTimeout:       wsIdleTimeout,
+	}
+	go srv.Serve(l)
+	return wl, nil
+}
+
+// wsConn reports the addresses of the underlying connection rather than
+// WebSocket locations.
+type wsConn struct {
+	*websocket.Conn
+	laddr, raddr net.Addr
+	once         sync.Once
+	closed       chan struct{} // server side only
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *wsConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *wsConn) Close() error {
+	if c.closed != nil {
+		c.once.Do(func() { close(c.closed) })
+	}
+	return c.Conn.Close()
+}
+
+// wsListener accepts WebSocket connections upgraded by its HTTP server.
+type wsListener struct {
+	net.Listener
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func (l *wsListener) handle(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	r := ws.Request()
+	c := &wsConn{Conn: ws, closed: make(chan struct{})}
+	c.laddr, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if a, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		c.raddr = a
+	}
+	select {
+	case l.conns <- c:
+		<-c.closed // the connection closes once handled
+	case <-l.done:
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting. Connections accepted already are not affected.
+func (l *wsListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
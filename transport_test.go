@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/riobard/go-shadowsocks2/core"
+	"github.com/riobard/go-shadowsocks2/socks"
+)
+
+// listenTransport serves the transport of server URL s on loopback, relaying
+// through tcpRemote until the test ends, and returns its address.
+func listenTransport(t *testing.T, s string) (string, core.Cipher) {
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := parseTransport(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, err := tr.listen(l)
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	u, commit, err := serverUser(s, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		tl.Close()
+		cancel()
+	})
+	go tcpRemote(ctx, tl, ciph.StreamConn, &remote{user: u, dialTimeout: 5 * time.Second})
+	return addr, ciph
+}
+
+// relayThrough sends a message to an echo server through the server at addr
+// and checks it comes back.
+func relayThrough(t *testing.T, tr *transport, addr string, ciph core.Cipher) {
+	t.Helper()
+	echo := echoServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	c, err := tr.dial(ctx, addr)
+	cancel() // a done ctx must not affect the connection dialed
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sc := ciph.StreamConn(c)
+	if _, err := sc.Write(socks.ParseAddr(echo)); err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTripConn(sc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransportWS(t *testing.T) {
+	s := "ss://AEAD_CHACHA20_POLY1305:test@127.0.0.1:0/?transport=ws&path=/ws"
+	addr, ciph := listenTransport(t, s)
+	tr, err := parseTransport(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayThrough(t, tr, addr, ciph)
+
+	other := *tr
+	other.path = "/other"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if c, err := other.dial(ctx, addr); err == nil {
+		c.Close()
+		t.Error("dialed a path not served")
+	}
+}
+
+func TestTransportWSS(t *testing.T) {
+	cert, key := testCert(t)
+	t.Setenv("SSL_CERT_FILE", cert) // trust the test certificate
+	s := "ss://AEAD_CHACHA20_POLY1305:test@127.0.0.1:0/?transport=wss&cert=" + cert + "&key=" + key
+	addr, ciph := listenTransport(t, s)
+	tr, err := parseTransport(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayThrough(t, tr, addr, ciph)
+
+	plain := *tr
+	plain.tls = false
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if c, err := plain.dial(ctx, addr); err == nil {
+		c.Close()
+		t.Error("dialed wss without TLS")
+	}
+}
+
+func TestTransportDialTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0") // never answers the handshake
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	tr := &transport{ws: true, path: "/"}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	if c, err := tr.dial(ctx, l.Addr().String()); err == nil {
+		c.Close()
+		t.Fatal("handshake without answer succeeded")
+	}
+	if d := time.Since(t0); d > 2*time.Second {
+		t.Errorf("dial gave up after %v", d)
+	}
+}
+
+func TestWSListenerClose(t *testing.T) {
+	tr := &transport{ws: true, path: "/"}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wl, err := tr.listen(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// upgraded but never accepted, so its handler waits
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := tr.dial(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	wl.Close()
+	if _, err := wl.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("accept after close: %v", err)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("handler still waiting after the listener closed")
+	}
+}
+
+// test certificate and key in PEM, generated once as the system roots it
+// is trusted by through SSL_CERT_FILE are loaded once
+var testCertPEM struct {
+	once      sync.Once
+	cert, key []byte
+	err       error
+}
+
+// testCert writes a self-signed certificate for 127.0.0.1 and its key, and
+// returns their files.
+func testCert(t *testing.T) (cert, key string) {
+	c := &testCertPEM
+	c.once.Do(func() { c.cert, c.key, c.err = generateCert() })
+	if c.err != nil {
+		t.Fatal(c.err)
+	}
+	dir := t.TempDir()
+	cert, key = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(cert, c.cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(key, c.key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func generateCert() (cert, key []byte, err error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
@@ -1,164 +1,157 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/riobard/go-shadowsocks2/socks"
+	"golang.org/x/net/ipv4"
 )
 
 const udpBufSize = 64 * 1024
 
 var bufPool = sync.Pool{New: func() interface{} { return make([]byte, udpBufSize) }}
 
-// Listen on laddr for UDP packets, encrypt and send to server to reach target.
-func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.PacketConn) {
-	srvAddr, err := net.ResolveUDPAddr("udp", server)
-	if err != nil {
-		logf("UDP server address error: %v", err)
-		return
-	}
-
-	tgt := socks.ParseAddr(target)
-	if tgt == nil {
-		err = fmt.Errorf("invalid target address: %q", target)
-		logf("UDP target address error: %v", err)
-		return
-	}
-
-	c, err := net.ListenPacket("udp", laddr)
-	if err != nil {
-		logf("UDP local listen error: %v", err)
-		return
-	}
+// Read UDP packets from c, encrypt and send to one of servers to reach target.
+// Each session sticks to the server picked when it starts. Sessions are
+// closed once ctx is done.
+func udpLocal(ctx context.Context, c net.PacketConn, servers []*udpServer, tgt socks.Addr) {
 	defer c.Close()
+	c = batchable(c)
 
-	m := make(map[string]chan []byte)
+	m := make(map[string]*udpQueue)
 	var lock sync.Mutex
 
-	logf("UDP tunnel %s <-> %s <-> %s", laddr, server, target)
-	for {
-		buf := bufPool.Get().([]byte)
-		copy(buf, tgt)
-		n, raddr, err := c.ReadFrom(buf[len(tgt):])
-		if err != nil {
-			logf("UDP local read error: %v", err)
-			continue
-		}
-
-		lock.Lock()
+	// push queues buf from raddr to its session, starting one if needed.
+	// Caller must hold lock.
+	push := func(raddr net.Addr, buf []byte) {
 		k := raddr.String()
-		ch := m[k]
-		if ch == nil {
-			pc, err := net.ListenPacket("udp", "")
-			if err != nil {
-				logf("failed to create UDP socket: %v", err)
-				goto Unlock
-			}
-			pc = shadow(pc)
-			ch = make(chan []byte, 1) // must use buffered chan
-			m[k] = ch
+		q := m[k]
+		if q == nil {
+			q = newUDPQueue("client")
+			m[k] = q
 
 			go func() { // recv from user and send to udpRemote
-				for buf := range ch {
-					pc.SetReadDeadline(time.Now().Add(config.UDPTimeout)) // extend read timeout
-					if _, err := pc.WriteTo(buf, srvAddr); err != nil {
-						logf("UDP local write error: %v", err)
+				srv := pickUDPServer(servers)
+				pc, err := srv.listen() // may dial over TCP, so not under lock
+				if err != nil {
+					logf("failed to create UDP session via %s: %v", srv.host, err)
+					lock.Lock()
+					q.close()
+					delete(m, k)
+					lock.Unlock()
+					for buf := range q.ch {
+						q.release(buf)
 					}
-					bufPool.Put(buf[:cap(buf)])
+					return
 				}
-			}()
+				go func() { // recv from udpRemote and send to user
+					untrack := track(ctx, pc, &inflight.udpLocal)
+					if err := timedCopy(raddr, c, pc, config.UDPTimeout, false); err != nil {
+						if err, ok := err.(net.Error); ok && err.Timeout() {
+							// ignore i/o timeout
+						} else {
+							logf("timedCopy error: %v", err)
+						}
+					}
+					pc.Close()
+					untrack()
+					lock.Lock()
+					if q := m[k]; q != nil {
+						q.close()
+					}
+					delete(m, k)
+					lock.Unlock()
+				}()
 
-			go func() { // recv from udpRemote and send to user
-				if err := timedCopy(raddr, c, pc, config.UDPTimeout, false); err != nil {
-					if err, ok := err.(net.Error); ok && err.Timeout() {
-						// ignore i/o timeout
+				for buf := range q.ch {
+					pc.SetReadDeadline(time.Now().Add(config.UDPTimeout)) // extend read timeout
+					if _, err := pc.WriteTo(buf, srv.addr); err != nil {
+						logf("UDP local write error: %v", err)
 					} else {
-						logf("timedCopy error: %v", err)
+						metrics.bytes.Add(byteLabels("udp", "client", "upload"), int64(len(buf)-len(tgt)))
 					}
+					q.release(buf)
 				}
-				pc.Close()
-				lock.Lock()
-				if ch := m[k]; ch != nil {
-					close(ch)
-				}
-				delete(m, k)
-				lock.Unlock()
 			}()
 		}
-	Unlock:
-		lock.Unlock()
-
-		select {
-		case ch <- buf[:len(tgt)+n]: // send
-		default: // drop
-			bufPool.Put(buf)
-		}
+		q.push(buf)
 	}
-}
 
-// Listen on addr for encrypted packets and basically do UDP NAT.
-func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
-	c, err := net.ListenPacket("udp", addr)
-	if err != nil {
-		logf("UDP remote listen error: %v", err)
-		return
+	var bufs [batchSize][]byte // plain sockets keep the order of ms
+	ms := make([]ipv4.Message, batchSize)
+	for i := range ms {
+		ms[i].Buffers = make([][]byte, 1)
 	}
-	defer c.Close()
-	c = shadow(c)
-
-	m := make(map[string]chan []byte)
-	var lock sync.Mutex
-
-	logf("listening UDP on %s", addr)
 	for {
-		buf := bufPool.Get().([]byte)
-		n, raddr, err := c.ReadFrom(buf)
+		for i := range ms {
+			if bufs[i] == nil {
+				bufs[i] = bufPool.Get().([]byte)
+				copy(bufs[i], tgt)
+				ms[i].Buffers[0] = bufs[i][len(tgt):]
+			}
+		}
+		nm, err := readBatch(c, ms)
 		if err != nil {
-			logf("UDP remote read error: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logf("UDP local read error: %v", err)
 			continue
 		}
 
 		lock.Lock()
+		for i := 0; i < nm; i++ {
+			buf, raddr := bufs[i][:len(tgt)+ms[i].N], ms[i].Addr
+			bufs[i] = nil
+			push(raddr, buf)
+		}
+		lock.Unlock()
+	}
+}
+
+// Read encrypted packets from c and basically do UDP NAT for r. Sessions are
+// closed once ctx is done.
+func udpRemote(ctx context.Context, c net.PacketConn, shadow func(net.PacketConn) net.PacketConn, r *remote) {
+	defer c.Close()
+	c = shadow(batchable(c))
+
+	m := make(map[string]*udpQueue)
+	var lock sync.Mutex
+
+	// push queues buf from raddr to its session, starting one if needed.
+	// Caller must hold lock.
+	push := func(raddr net.Addr, buf []byte) {
 		k := raddr.String()
-		ch := m[k]
-		if ch == nil {
-			pc, err := net.ListenPacket("udp", "")
+		q := m[k]
+		if q == nil {
+			pc, release, err := r.listenTarget(raddr)
 			if err != nil {
-				logf("failed to create UDP socket: %v", err)
-				goto Unlock
+				log.Printf("reject %v: %v", raddr, err)
+				bufPool.Put(buf[:cap(buf)])
+				return
 			}
-			ch = make(chan []byte, 1) // must use buffered chan
-			m[k] = ch
+			q = newUDPQueue("server")
+			m[k] = q
 
 			go func() { // receive from udpLocal and send to target
-				var tgtUDPAddr *net.UDPAddr
-				var err error
-
-				for buf := range ch {
-					tgtAddr := socks.SplitAddr(buf)
-					if tgtAddr == nil {
-						logf("failed to split target address from packet: %q", buf)
-						goto End
-					}
-					tgtUDPAddr, err = net.ResolveUDPAddr("udp", tgtAddr.String())
-					if err != nil {
-						logf("failed to resolve target UDP address: %v", err)
-						goto End
-					}
-					pc.SetReadDeadline(time.Now().Add(config.UDPTimeout))
-					if _, err = pc.WriteTo(buf[len(tgtAddr):], tgtUDPAddr); err != nil {
+				for buf := range q.ch {
+					if err := sendTarget(pc, buf); err != nil {
 						logf("UDP remote write error: %v", err)
-						goto End
 					}
-				End:
-					bufPool.Put(buf[:cap(buf)])
+					q.release(buf)
 				}
 			}()
 
 			go func() { // receive from udpLocal and send to client
+				untrack := track(ctx, pc, &inflight.udpRemote)
+				defer release()
 				if err := timedCopy(raddr, c, pc, config.UDPTimeout, true); err != nil {
 					if err, ok := err.(net.Error); ok && err.Timeout() {
 						// ignore i/o timeout
@@ -167,49 +160,121 @@ func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
 					}
 				}
 				pc.Close()
+				untrack()
 				lock.Lock()
-				if ch := m[k]; ch != nil {
-					close(ch)
+				if q := m[k]; q != nil {
+					q.close()
 				}
 				delete(m, k)
 				lock.Unlock()
 			}()
 		}
-	Unlock:
-		lock.Unlock()
+		q.push(buf)
+	}
 
-		select {
-		case ch <- buf[:n]: // sent
-		default: // drop
-			bufPool.Put(buf)
+	ms := make([]ipv4.Message, batchSize)
+	for i := range ms {
+		ms[i].Buffers = make([][]byte, 1)
+	}
+	for {
+		for i := range ms {
+			if ms[i].Buffers[0] == nil {
+				ms[i].Buffers[0] = bufPool.Get().([]byte)
+			}
+		}
+		nm, err := readBatch(c, ms)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logf("UDP remote read error: %v", err)
+			continue
 		}
+
+		lock.Lock()
+		for i := 0; i < nm; i++ {
+			buf, raddr := ms[i].Buffers[0][:ms[i].N], ms[i].Addr
+			ms[i].Buffers[0] = nil
+			push(raddr, buf)
+		}
+		lock.Unlock()
+	}
+}
+
+// listenTarget opens the outbound socket of a new session of client raddr.
+// Call release once the session is done.
+func (r *remote) listenTarget(raddr net.Addr) (pc net.PacketConn, release func(), err error) {
+	if err := r.user.check(); err != nil {
+		return nil, nil, err
+	}
+	pc, err = net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create UDP socket: %v", err)
+	}
+	ipLim, release := ipLimit(raddr)
+	pc = limitTargetPacket(&countPacketConn{filterNAT(pc, r.nat), &r.user.month}, r.lim, r.user.limiter(), ipLim)
+	return pc, release, nil
+}
+
+// sendTarget sends the payload of buf to the target address it starts with.
+func sendTarget(pc net.PacketConn, buf []byte) error {
+	tgtAddr := socks.SplitAddr(buf)
+	if tgtAddr == nil {
+		return fmt.Errorf("failed to split target address from packet: %q", buf)
+	}
+	tgtUDPAddr, err := targetDNS().ResolveUDPAddr(context.Background(), tgtAddr.String())
+	if err != nil {
+		return fmt.Errorf("failed to resolve target UDP address: %v", err)
 	}
+	pc.SetReadDeadline(time.Now().Add(config.UDPTimeout))
+	if _, err = pc.WriteTo(buf[len(tgtAddr):], tgtUDPAddr); err != nil {
+		return err
+	}
+	metrics.bytes.Add(byteLabels("udp", "server", "upload"), int64(len(buf)-len(tgtAddr)))
+	return nil
 }
 
 // copy from src to dst at target with read timeout
 func timedCopy(target net.Addr, dst, src net.PacketConn, timeout time.Duration, prependSrcAddr bool) error {
-	buf := bufPool.Get().([]byte)
-	defer bufPool.Put(buf)
+	ms := make([]ipv4.Message, batchSize)
+	out := make([]ipv4.Message, batchSize)
+	for i := range ms {
+		buf := bufPool.Get().([]byte)
+		defer bufPool.Put(buf)
+		ms[i].Buffers = [][]byte{buf}
+		out[i].Buffers = make([][]byte, 1)
+		out[i].Addr = target
+	}
+
+	mode := "client"
+	if prependSrcAddr {
+		mode = "server"
+	}
+	down := metrics.bytes.get(byteLabels("udp", mode, "download"))
 
 	for {
 		src.SetReadDeadline(time.Now().Add(timeout))
-		n, raddr, err := src.ReadFrom(buf)
+		nm, err := readBatch(src, ms)
 		if err != nil {
 			return err
 		}
 
-		if prependSrcAddr { // server -> client: prepend original packet source address
-			srcAddr := socks.ParseAddr(raddr.String())
-			copy(buf[len(srcAddr):], buf[:n])
-			copy(buf, srcAddr)
-			if _, err = dst.WriteTo(buf[:len(srcAddr)+n], target); err != nil {
-				return err
-			}
-		} else { // client -> user: strip original packet source address
-			srcAddr := socks.SplitAddr(buf[:n])
-			if _, err = dst.WriteTo(buf[len(srcAddr):n], target); err != nil {
-				return err
+		for i := 0; i < nm; i++ {
+			buf, n := ms[i].Buffers[0], ms[i].N
+			if prependSrcAddr { // server -> client: prepend original packet source address
+				atomic.AddInt64(down, int64(n))
+				srcAddr := socks.ParseAddr(ms[i].Addr.String())
+				copy(buf[len(srcAddr):], buf[:n])
+				copy(buf, srcAddr)
+				out[i].Buffers[0] = buf[:len(srcAddr)+n]
+			} else { // client -> user: strip original packet source address
+				srcAddr := socks.SplitAddr(buf[:n])
+				atomic.AddInt64(down, int64(n-len(srcAddr)))
+				out[i].Buffers[0] = buf[len(srcAddr):n]
 			}
 		}
+		if err := writeBatch(dst, out[:nm]); err != nil {
+			return err
+		}
 	}
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// settings of per-session UDP queues
+type udpQueueSettings struct {
+	size       int   // packets per session
+	maxBufs    int64 // buffers queued across all sessions
+	dropOldest bool
+}
+
+// holds the current *udpQueueSettings, replaced on reload. Sessions keep the
+// queue size they started with.
+var udpQueueConfig atomic.Value
+
+func udpQueueSetting() *udpQueueSettings { return udpQueueConfig.Load().(*udpQueueSettings) }
+
+// number of bufPool buffers queued across all sessions
+var udpQueued int64
+
+// prepareUDPQueue returns a function changing the UDP queue settings to those
+// of cfg.
+func prepareUDPQueue(cfg *Config) (func(), error) {
+	mem, err := parseSize(cfg.UDPQueueMem)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UDP queue memory %q: %v", cfg.UDPQueueMem, err)
+	}
+	if cfg.UDPQueue < 1 {
+		return nil, fmt.Errorf("invalid UDP queue size %d", cfg.UDPQueue)
+	}
+	st := &udpQueueSettings{size: cfg.UDPQueue, maxBufs: mem / udpBufSize}
+	switch cfg.UDPDrop {
+	case "newest":
+	case "oldest":
+		st.dropOldest = true
+	default:
+		return nil, fmt.Errorf("invalid UDP drop policy %q", cfg.UDPDrop)
+	}
+	return func() { udpQueueConfig.Store(st) }, nil
+}
+
+// udpQueue holds packets of a session waiting to be written. Buffers come
+// from bufPool and count against the global memory cap while queued.
+type udpQueue struct {
+	ch    chan []byte
+	mode  string // client or server
+	drops *int64
+}
+
+func newUDPQueue(mode string) *udpQueue {
+	return &udpQueue{
+		ch:    make(chan []byte, udpQueueSetting().size),
+		mode:  mode,
+		drops: metrics.udpDrops.get(fmt.Sprintf("mode=%q,reason=%q", mode, "queue")),
+	}
+}
+
+// push queues buf without blocking, dropping a packet if the queue is full.
+// Must not be called concurrently with close.
+func (q *udpQueue) push(buf []byte) {
+	if atomic.AddInt64(&udpQueued, 1) > udpQueueSetting().maxBufs {
+		atomic.AddInt64(&udpQueued, -1)
+		metrics.udpDrops.Add(fmt.Sprintf("mode=%q,reason=%q", q.mode, "memory"), 1)
+		bufPool.Put(buf[:cap(buf)])
+		return
+	}
+	for {
+		select {
+		case q.ch <- buf:
+			return
+		default:
+		}
+		atomic.AddInt64(q.drops, 1)
+		if !udpQueueSetting().dropOldest {
+			q.release(buf)
+			return
+		}
+		select {
+		case old := <-q.ch:
+			q.release(old)
+		default: // drained by the writer meanwhile
+		}
+	}
+}
+
+// release returns a buffer taken from the queue to bufPool.
+func (q *udpQueue) release(buf []byte) {
+	atomic.AddInt64(&udpQueued, -1)
+	bufPool.Put(buf[:cap(buf)])
+}
+
+func (q *udpQueue) close() { close(q.ch) }
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/riobard/go-shadowsocks2/core"
+	"github.com/riobard/go-shadowsocks2/socks"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// A server is considered down for new UDP sessions once it has not returned
+// any packet for this long since it was sent one.
+const udpStall = 5 * time.Second
+
+// How long a stalled server gets no new sessions before being tried again,
+// doubling with each retry in a row that stalls too, up to udpRetryMax.
+const (
+	udpRetry    = 30 * time.Second
+	udpRetryMax = 10 * time.Minute
+)
+
+// How long an auto server sticks to UDP over TCP before trying UDP again.
+const uotRetry = 10 * time.Minute
+
+// Resolver an auto server is probed with once it stalls, unless -dnsupstream
+// is reached over UDP.
+const udpProbeDNS = "8.8.8.8:53"
+
+// Transports of UDP sessions, selected by udp=native|tcp|auto in client URLs.
+const (
+	udpNative = iota // native UDP only
+	udpTCP           // UDP over TCP only
+	udpAuto          // native UDP, falling back to TCP when the server drops it
+)
+
+// udpServer is a server UDP sessions of the client can be pinned to.
+type udpServer struct {
+	addr     net.Addr
+	host     string // as in the client URL, to look up its TCP latency
+	shadow   func(net.PacketConn) net.PacketConn
+	mode     int
+	since    int64      // unix nanoseconds of the first packet not answered yet, 0 if none
+	retries  int32      // stalled retries in a row
+	tcpSince int64      // unix nanoseconds an auto server fell back to TCP, 0 if not
+	probe    socks.Addr // DNS resolver queried through an auto server that stalled
+	probing  int32      // 1 while probing
+}
+
+// udpServers returns the UDP servers of client URLs, probing auto ones through
+// the DNS resolver at probe.
+func udpServers(urls []string, probe string) ([]*udpServer, error) {
+	tgt := socks.ParseAddr(probe)
+	if tgt == nil {
+		return nil, fmt.Errorf("invalid UDP probe address %q", probe)
+	}
+	servers := make([]*udpServer, len(urls))
+	for i, each := range urls {
+		addr, cipher, password, err := parseURL(each)
+		if err != nil {
+			return nil, err
+		}
+		ciph, err := core.PickCipher(cipher, nil, password)
+		if err != nil {
+			return nil, err
+		}
+		mode, err := parseUDPMode(each)
+		if err != nil {
+			return nil, err
+		}
+		servers[i] = &udpServer{host: addr, shadow: ciph.PacketConn, mode: mode, probe: tgt}
+	}
+	return servers, nil
+}
+
+// resolveUDPServers looks up the addresses of servers.
+func resolveUDPServers(servers []*udpServer) error {
+	for _, s := range servers {
+		srvAddr, err := net.ResolveUDPAddr("udp", s.host)
+		if err != nil {
+			return fmt.Errorf("UDP server address error: %v", err)
+		}
+		s.addr = srvAddr
+	}
+	return nil
+}
+
+func parseUDPMode(s string) (int, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return 0, err
+	}
+	switch m := u.Query().Get("udp"); m {
+	case "", "native":
+		return udpNative, nil
+	case "auto":
+		return udpAuto, nil
+	case "tcp":
+		return udpTCP, nil
+	default:
+		return 0, fmt.Errorf("invalid UDP transport %q", m)
+	}
+}
+
+// overTCP reports whether new sessions to s go over TCP. An auto server that
+// stalls is probed, and falls back to TCP only if the probe gets no answer
+// either, as targets not answering does not mean s drops UDP. It tries native
+// UDP again later.
+func (s *udpServer) overTCP() bool {
+	switch s.mode {
+	case udpTCP:
+		return true
+	case udpAuto:
+		t := atomic.LoadInt64(&s.tcpSince)
+		switch {
+		case t == 0:
+			if s.stalled() && atomic.CompareAndSwapInt32(&s.probing, 0, 1) {
+				go s.probeUDP()
+			}
+			return false
+		case time.Since(time.Unix(0, t)) > uotRetry:
+			logf("UDP over TCP to %s expired, trying UDP again", s.host)
+			atomic.StoreInt64(&s.tcpSince, 0)
+			atomic.StoreInt64(&s.since, 0) // judge health of native UDP afresh
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// probeUDP queries the probe resolver through s over native UDP, and falls
+// back to UDP over TCP unless it answers.
+func (s *udpServer) probeUDP() {
+	defer atomic.StoreInt32(&s.probing, 0)
+	if err := s.exchangeProbe(); err != nil {
+		logf("UDP to %s stalled and probe failed: %v, falling back to UDP over TCP", s.host, err)
+		atomic.StoreInt64(&s.tcpSince, time.Now().UnixNano())
+		atomic.StoreInt64(&s.since, 0) // judge health of UDP over TCP afresh
+		return
+	}
+	logf("UDP to %s answered a probe, keeping native UDP", s.host)
+	s.answered()
+}
+
+// exchangeProbe sends a DNS query for the root name servers to the probe
+// resolver through s and waits for its answer.
+func (s *udpServer) exchangeProbe() error {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET})
+	q, err := b.Finish()
+	if err != nil {
+		return err
+	}
+
+	c, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return err
+	}
+	pc := s.shadow(c)
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(udpStall))
+	if _, err := pc.WriteTo(append(append([]byte(nil), s.probe...), q...), s.addr); err != nil {
+		return err
+	}
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		src := socks.SplitAddr(buf[:n])
+		if resp := buf[len(src):n]; len(resp) >= 2 && bytes.Equal(resp[:2], q[:2]) {
+			return nil
+		}
+	}
+}
+
+// listen opens the socket of a new session to s.
+func (s *udpServer) listen() (net.PacketConn, error) {
+	if s.overTCP() {
+		pc, err := dialUoT(s.host)
+		if err != nil {
+			return nil, err
+		}
+		return &healthConn{pc, s}, nil
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return &healthConn{s.shadow(batchable(pc)), s}, nil
+}
+
+// stalled reports whether s has not answered for udpStall. Once stalled for
+// the retry backoff as well, s gets another chance.
+func (s *udpServer) stalled() bool {
+	t := atomic.LoadInt64(&s.since)
+	if t == 0 {
+		return false
+	}
+	age := time.Since(time.Unix(0, t))
+	if age <= udpStall {
+		return false
+	}
+	n := atomic.LoadInt32(&s.retries)
+	retry := udpRetryMax
+	if n < 8 && udpRetry<<n < udpRetryMax {
+		retry = udpRetry << n
+	}
+	if age > udpStall+retry {
+		if atomic.CompareAndSwapInt64(&s.since, t, 0) {
+			atomic.AddInt32(&s.retries, 1)
+			logf("UDP to %s stalled for %v, trying again", s.host, age)
+		}
+		return false
+	}
+	return true
+}
+
+// answered records a packet from s.
+func (s *udpServer) answered() {
+	atomic.StoreInt64(&s.since, 0)
+	atomic.StoreInt32(&s.retries, 0)
+}
+
+// pickUDPServer returns the server with the lowest smoothed TCP latency among
+// those still answering, or among all of them if none is.
+func pickUDPServer(servers []*udpServer) *udpServer {
+	for _, s := range servers {
+		s.overTCP() // probe stalled auto servers, or let them fall back, before judging health
+	}
+
+	var best *udpServer
+	var min time.Duration
+	for _, healthy := range []bool{true, false} {
+		for _, s := range servers {
+			if healthy && s.stalled() {
+				continue
+			}
+			l := serverLatency(s.host)
+			if best == nil || (l > 0 && (min == 0 || l < min)) {
+				best, min = s, l
+			}
+		}
+		if best != nil {
+			return best
+		}
+	}
+	return nil
+}
+
+// serverLatency returns the smoothed latency of dialing the server at addr,
+// or 0 if unknown.
+func serverLatency(addr string) time.Duration {
+	d, ok := clientDialer.v.Load().(*dialer)
+	if !ok {
+		return 0
+	}
+	stats := d.Stats()
+	for i := range d.addrs {
+		if d.addrs[i] == addr && i < len(stats) {
+			return stats[i].Latency
+		}
+	}
+	return 0
+}
+
+// healthConn tracks whether packets sent to a server get answered.
+type healthConn struct {
+	net.PacketConn
+	srv *udpServer
+}
+
+func (c *healthConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	atomic.CompareAndSwapInt64(&c.srv.since, 0, time.Now().UnixNano())
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *healthConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		c.srv.answered()
+	}
+	return n, addr, err
+}
+
+func (c *healthConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	n, err := readBatch(c.PacketConn, ms)
+	if n > 0 {
+		c.srv.answered()
+	}
+	return n, err
+}
+
+func (c *healthConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	atomic.CompareAndSwapInt64(&c.srv.since, 0, time.Now().UnixNano())
+	if err := writeBatch(c.PacketConn, ms); err != nil {
+		return 0, err
+	}
+	return len(ms), nil
+}
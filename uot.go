@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/riobard/go-shadowsocks2/socks"
+)
+
+// uotTarget is the reserved target address of a stream carrying UDP over TCP.
+var uotTarget = socks.ParseAddr("udp-over-tcp.invalid:0")
+
+var errPacketTooLarge = errors.New("packet too large")
+
+// uotConn carries packets over a stream, each prefixed by its 2-byte
+// big-endian length. Like packets of a shadowaead.PacketConn, each packet
+// starts with a socks.Addr: the target from the client and the source from
+// the server.
+type uotConn struct {
+	net.Conn
+	wmu sync.Mutex
+}
+
+func (c *uotConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(c.Conn, h[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(h[0])<<8 | int(h[1])
+	if n > len(b) {
+		return 0, nil, io.ErrShortBuffer
+	}
+	_, err := io.ReadFull(c.Conn, b[:n])
+	return n, c.RemoteAddr(), err
+}
+
+// WriteTo writes b as a single packet. addr is ignored.
+func (c *uotConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > 0xFFFF {
+		return 0, errPacketTooLarge
+	}
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+	if len(b)+2 > len(buf) {
+		return 0, errPacketTooLarge
+	}
+	buf[0], buf[1] = byte(len(b)>>8), byte(len(b))
+	copy(buf[2:], b)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.Conn.Write(buf[:2+len(b)]); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// time to connect a UDP over TCP session
+const uotDialTimeout = 10 * time.Second
+
+// dialUoT opens a UDP over TCP session to the server at addr, the same way
+// TCP connections reach it.
+func dialUoT(addr string) (net.PacketConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), uotDialTimeout)
+	defer cancel()
+	c, err := dialServer(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(uotTarget); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &uotConn{Conn: c}, nil
+}
+
+// uotRemote does UDP NAT for a single client session carried over c.
+func uotRemote(ctx context.Context, c net.Conn, r *remote) {
+	uc := &uotConn{Conn: c}
+	pc, release, err := r.listenTarget(c.RemoteAddr())
+	if err != nil {
+		log.Printf("reject %v: %v", c.RemoteAddr(), err)
+		return
+	}
+	defer release()
+	defer pc.Close()
+	defer track(ctx, pc, &inflight.udpRemote)()
+
+	logf("UDP over TCP %s", c.RemoteAddr())
+	go func() { // receive from target and send to client
+		if err := timedCopy(c.RemoteAddr(), uc, pc, config.UDPTimeout, true); err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				// ignore i/o timeout
+			} else {
+				logf("timedCopy error: %v", err)
+			}
+		}
+		c.Close()
+	}()
+
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+	for {
+		n, _, err := uc.ReadFrom(buf)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				logf("UDP over TCP read error: %v", err)
+			}
+			return
+		}
+		if err := sendTarget(pc, buf[:n]); err != nil {
+			logf("UDP remote write error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// user accounts traffic of a server key. A user is named by the fragment of
+// its server URL, e.g. ss://AEAD_CHACHA20_POLY1305:pass@:8488?quota=10G&period=month#alice
+// Rates of all connections of a user are capped together by userlimit=UP,DOWN.
+type user struct {
+	month int64 // bytes this month, updated atomically
+
+	sync.Mutex
+	name    string
+	past    int64  // bytes before this month
+	period  string // current month as YYYY-MM
+	quota   int64  // in bytes, 0 for unlimited
+	monthly bool   // quota applies to each month instead of total
+	lim     *limiter
+	limSpec string
+}
+
+var users = struct {
+	sync.Mutex
+	m map[string]*user
+}{m: make(map[string]*user)}
+
+// getUser returns the user of the given name, creating it if needed.
+func getUser(name string) *user {
+	users.Lock()
+	defer users.Unlock()
+	u := users.m[name]
+	if u == nil {
+		u = &user{name: name, period: time.Now().Format("2006-01")}
+		users.m[name] = u
+	}
+	return u
+}
+
+// serverUser returns the user of server URL s listening on addr, and a
+// function applying the quota and limit in s to it.
+func serverUser(s, addr string) (*user, func(), error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	name := u.Fragment
+	if name == "" {
+		name = addr
+	}
+
+	q := u.Query()
+	var quota int64
+	if v := q.Get("quota"); v != "" {
+		if quota, err = parseSize(v); err != nil {
+			return nil, nil, fmt.Errorf("invalid quota %q: %v", v, err)
+		}
+	}
+	var monthly bool
+	switch p := q.Get("period"); p {
+	case "", "total":
+	case "month":
+		monthly = true
+	default:
+		return nil, nil, fmt.Errorf("invalid quota period %q", p)
+	}
+
+	spec := q.Get("userlimit")
+	lim, err := parseLimit(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	usr := getUser(name)
+	return usr, func() {
+		usr.Lock()
+		usr.quota, usr.monthly = quota, monthly
+		if spec != usr.limSpec { // keep sharing the current buckets otherwise
+			usr.lim, usr.limSpec = lim, spec
+		}
+		usr.Unlock()
+	}, nil
+}
+
+// parseSize parses a byte size with an optional K, M, G or T suffix.
+func parseSize(s string) (int64, error) {
+	shift := 0
+	if i := strings.IndexAny(s, "KMGT"); i > 0 && i == len(s)-1 {
+		shift = 10 * (1 + strings.IndexByte("KMGT", s[i]))
+		s = s[:i]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n << shift, err
+}
+
+// roll moves this month's bytes to the past once the month is over. Caller
+// must hold the lock.
+func (u *user) roll() {
+	if p := time.Now().Format("2006-01"); p != u.period {
+		u.past += atomic.SwapInt64(&u.month, 0)
+		u.period = p
+	}
+}
+
+// check returns an error if u has exceeded its quota.
+func (u *user) check() error {
+	u.Lock()
+	defer u.Unlock()
+	u.roll()
+	used := atomic.LoadInt64(&u.month)
+	if !u.monthly {
+		used += u.past
+	}
+	if u.quota > 0 && used >= u.quota {
+		return fmt.Errorf("user %s exceeded quota: %d of %d bytes used", u.name, used, u.quota)
+	}
+	return nil
+}
+
+func (u *user) limiter() *limiter {
+	u.Lock()
+	defer u.Unlock()
+	return u.lim
+}
+
+// countConn counts bytes in both directions of c for u.
+func (u *user) countConn(c net.Conn) net.Conn { return &countConn{c, &u.month, &u.month} }
+
+// countPacketConn counts bytes read from and written to the embedded net.PacketConn.
+type countPacketConn struct {
+	net.PacketConn
+	n *int64
+}
+
+func (c *countPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, addr, err
+}
+
+func (c *countPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// usage is the persisted and reported form of a user.
+type usage struct {
+	Period  string `json:"period"`
+	Month   int64  `json:"month"`
+	Total   int64  `json:"total"`
+	Quota   int64  `json:"quota,omitempty"`
+	Monthly bool   `json:"monthly,omitempty"`
+}
+
+// usages returns a snapshot of all users.
+func usages() map[string]usage {
+	users.Lock()
+	defer users.Unlock()
+	m := make(map[string]usage, len(users.m))
+	for name, u := range users.m {
+		u.Lock()
+		u.roll()
+		month := atomic.LoadInt64(&u.month)
+		m[name] = usage{Period: u.period, Month: month, Total: u.past + month, Quota: u.quota, Monthly: u.monthly}
+		u.Unlock()
+	}
+	return m
+}
+
+// loadUsage restores counters saved by saveUsage. A missing file is not an error.
+func loadUsage(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var m map[string]usage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for name, v := range m {
+		u := getUser(name)
+		u.Lock()
+		u.period, u.past = v.Period, v.Total-v.Month
+		atomic.StoreInt64(&u.month, v.Month)
+		u.roll()
+		u.Unlock()
+	}
+	return nil
+}
+
+// saveUsage writes counters of all users to path atomically.
+func saveUsage(path string) error {
+	b, err := json.MarshalIndent(usages(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// persistUsage saves counters to path every interval until ctx is done.
+func persistUsage(ctx context.Context, path string, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := saveUsage(path); err != nil {
+			logf("failed to save usage: %v", err)
+		}
+	}
+}